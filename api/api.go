@@ -0,0 +1,376 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
+	"github.com/Bnei-Baruch/mms-file-manager/logger"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+var l *log.Logger = logger.InitLogger(&logger.LogParams{LogMode: "screen", LogPrefix: "[API] "})
+
+type Server struct {
+	fm    *fm.FileManager
+	mux   *http.ServeMux
+	token string
+}
+
+/*
+ * Routes:
+ *   GET    /files                 - list files, see fileFilter for query parameters
+ *   GET    /files/{id}            - single file
+ *   GET    /files/{id}/history    - events of the file, oldest first
+ *   GET    /files/{id}/deliveries - webhook deliveries of the file, oldest first
+ *   POST   /files/{id}/release    - take the file out of quarantine and import it again
+ *   POST   /files/{id}/reprocess  - run a FAILED or INVALID file through the import again
+ *   GET    /watches               - watched pairs
+ *   POST   /watches               - watch a pair, body is a watch pair as in the config file
+ *   DELETE /watches?source={dir}  - stop watching a pair
+ *   GET    /queue                 - length of the import queue and running imports
+ *   GET    /jobs?status={status}  - pending and failed imports, oldest first
+ *   POST   /jobs/{id}/retry       - queue a failed import again
+ *
+ * Routes other than GET move files around, they require the token as
+ * "Authorization: Bearer <token>" and are disabled if the token is empty.
+ */
+func NewServer(fileManager *fm.FileManager, token string) *Server {
+	s := &Server{fm: fileManager, mux: http.NewServeMux(), token: token}
+	s.mux.HandleFunc("/files", s.files)
+	s.mux.HandleFunc("/files/", s.file)
+	s.mux.HandleFunc("/watches", s.watches)
+	s.mux.HandleFunc("/queue", s.queue)
+	s.mux.HandleFunc("/jobs", s.jobs)
+	s.mux.HandleFunc("/jobs/", s.job)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		if s.token == "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("method %s is disabled, the server has no token", req.Method))
+			return
+		}
+		if !s.authorized(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or bad token"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+func (s *Server) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) files(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+
+	filter, err := fileFilter(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	files, err := s.fm.ListFiles(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// file serves /files/{id} and its history, deliveries, release and
+// reprocess actions
+func (s *Server) file(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/files/"), "/")
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && action != "history" && action != "deliveries" && action != "release" && action != "reprocess") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", req.URL.Path))
+		return
+	}
+
+	method := "GET"
+	if action == "release" || action == "reprocess" {
+		method = "POST"
+	}
+	if req.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+
+	file, err := s.fm.FindFileById(parts[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if file == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("file %q not found", parts[0]))
+		return
+	}
+
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, file)
+	case "history":
+		events, err := s.fm.FileHistory(file.Id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	case "deliveries":
+		deliveries, err := s.fm.FileDeliveries(file.Id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deliveries)
+	case "release":
+		s.release(w, file)
+	case "reprocess":
+		s.reprocess(w, file)
+	}
+}
+
+// release runs the file through the pair watching its source
+func (s *Server) release(w http.ResponseWriter, file *fm.File) {
+	pair, ok := s.watchedPair(w, file)
+	if !ok {
+		return
+	}
+
+	file, err := s.fm.Release(file.Id, pair)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*fm.QuarantineError); ok {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+// reprocess is release for files that aren't quarantined
+func (s *Server) reprocess(w http.ResponseWriter, file *fm.File) {
+	if file.Status != fm.FileStatuses[fm.FailedFile] && file.Status != fm.FileStatuses[fm.InvalidFile] {
+		writeError(w, http.StatusConflict, fmt.Errorf("file %q is %s, only %s and %s files can be reprocessed",
+			file.Id, file.Status, fm.FileStatuses[fm.FailedFile], fm.FileStatuses[fm.InvalidFile]))
+		return
+	}
+	pair, ok := s.watchedPair(w, file)
+	if !ok {
+		return
+	}
+
+	file, err := s.fm.Reprocess(file.Id, pair)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, file)
+}
+
+// watchedPair returns the pair watching the source of the file,
+// answering the request if there's none
+func (s *Server) watchedPair(w http.ResponseWriter, file *fm.File) (fm.WatchPair, bool) {
+	pair, ok := s.fm.WatchedPair(file.Source)
+	if !ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("source %q of file %q is not watched", file.Source, file.Id))
+	}
+	return pair, ok
+}
+
+func (s *Server) watches(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.fm.ListWatches())
+
+	case "POST":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// JSON is valid YAML, parsing it as YAML keeps the config file
+		// field names and durations such as "5s"
+		pair := fm.WatchPair{}
+		if err = yaml.Unmarshal(body, &pair); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = s.fm.AddStoredWatch(pair); err != nil {
+			writeError(w, watchErrorStatus(err, http.StatusBadRequest), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, pair)
+
+	case "DELETE":
+		if err := s.fm.Unwatch(req.URL.Query().Get("source")); err != nil {
+			writeError(w, watchErrorStatus(err, http.StatusInternalServerError), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+}
+
+func (s *Server) queue(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.fm.QueueStats())
+}
+
+func (s *Server) jobs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+
+	jobs, err := s.fm.ListJobs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := req.URL.Query().Get("status")
+	selected := []*fm.Job{}
+	for _, job := range jobs {
+		if status == "" || job.Status == status {
+			selected = append(selected, job)
+		}
+	}
+	writeJSON(w, http.StatusOK, selected)
+}
+
+// job serves the retry action of /jobs/{id}
+func (s *Server) job(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "retry" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", req.URL.Path))
+		return
+	}
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+
+	job, err := s.fm.FindJob(parts[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if job == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %q not found", parts[0]))
+		return
+	}
+
+	if job, err = s.fm.RetryJob(job.Id); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*fm.JobError); ok {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func watchErrorStatus(err error, status int) int {
+	if e, ok := err.(*fm.WatchError); ok {
+		if e.Watched {
+			return http.StatusConflict
+		}
+		return http.StatusNotFound
+	}
+	return status
+}
+
+/*
+ * Query parameters:
+ *   status       - file status, e.g. VALID
+ *   source       - source directory of the watch pair
+ *   name         - substring of the file name
+ *   from, to     - creation date range, RFC3339 or YYYY-MM-DD
+ *   offset,limit - paging, limit defaults to 100 and can't exceed 1000
+ */
+func fileFilter(req *http.Request) (filter *fm.FileFilter, err error) {
+	q := req.URL.Query()
+	filter = &fm.FileFilter{
+		Status:       q.Get("status"),
+		Source:       q.Get("source"),
+		NameContains: q.Get("name"),
+		Limit:        defaultLimit,
+	}
+
+	if filter.CreatedAfter, err = parseTime(q.Get("from")); err != nil {
+		return nil, fmt.Errorf("bad from: %v", err)
+	}
+	if filter.CreatedBefore, err = parseTime(q.Get("to")); err != nil {
+		return nil, fmt.Errorf("bad to: %v", err)
+	}
+
+	if v := q.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return nil, fmt.Errorf("bad offset %q", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 || filter.Limit > maxLimit {
+			return nil, fmt.Errorf("bad limit %q, must be between 1 and %d", v, maxLimit)
+		}
+	}
+	return filter, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Println("Unable to write response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		l.Println(err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,293 @@
+package api_test
+
+import (
+	"encoding/json"
+	"github.com/Bnei-Baruch/mms-file-manager/api"
+	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+const token = "s3cret"
+
+var _ = Describe("Api", func() {
+	var (
+		fileManager *fm.FileManager
+		server      *httptest.Server
+		store       fm.FileStore
+		files       []*fm.File
+	)
+
+	BeforeEach(func() {
+		var err error
+		store = fm.NewMemoryStore()
+		now := time.Now()
+		files = []*fm.File{
+			{FileName: "lesson-1.mp3", Source: "tmp/source1", Status: "VALID", CreatedAt: now.Add(-48 * time.Hour)},
+			{FileName: "lesson-2.mp3", Source: "tmp/source1", Status: "INVALID", CreatedAt: now.Add(-time.Hour)},
+			{FileName: "song.mp3", Source: "tmp/source2", Status: "VALID", CreatedAt: now},
+		}
+		for _, file := range files {
+			Ω(store.CreateFile(file)).Should(Succeed())
+		}
+		Ω(store.AddEvent(&fm.FileEvent{FileId: files[0].Id, Action: fm.EventDetected})).Should(Succeed())
+
+		fileManager, err = fm.NewFMWithStore(store)
+		Ω(err).ShouldNot(HaveOccurred())
+		server = httptest.NewServer(api.NewServer(fileManager, token))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		fileManager.Destroy()
+	})
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		Ω(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		return res
+	}
+
+	get := func(path string, v interface{}) int {
+		res, err := http.Get(server.URL + path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Ω(json.NewDecoder(res.Body).Decode(v)).Should(Succeed())
+		return res.StatusCode
+	}
+
+	Describe("Authorization", func() {
+		It("rejects changes without the token", func() {
+			for _, auth := range []string{"", "Bearer wrong"} {
+				req, _ := http.NewRequest("POST", server.URL+"/watches", strings.NewReader(`{"source": "/", "target": "/tmp"}`))
+				req.Header.Set("Authorization", auth)
+				res, err := http.DefaultClient.Do(req)
+				Ω(err).ShouldNot(HaveOccurred())
+				res.Body.Close()
+				Ω(res.StatusCode).Should(Equal(http.StatusUnauthorized))
+			}
+			Ω(fileManager.ListWatches()).Should(BeEmpty())
+		})
+
+		It("disables changes without a token", func() {
+			open := httptest.NewServer(api.NewServer(fileManager, ""))
+			defer open.Close()
+
+			res, err := http.Post(open.URL+"/jobs/1/retry", "application/json", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Ω(res.StatusCode).Should(Equal(http.StatusForbidden))
+
+			res, err = http.Get(open.URL + "/files")
+			Ω(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Ω(res.StatusCode).Should(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("GET /files", func() {
+		It("lists all files", func() {
+			var result []fm.File
+			Ω(get("/files", &result)).Should(Equal(http.StatusOK))
+			Ω(result).Should(HaveLen(3))
+		})
+
+		It("filters files", func() {
+			var result []fm.File
+			get("/files?status=VALID&source=tmp/source1", &result)
+			Ω(result).Should(HaveLen(1))
+			Ω(result[0].FileName).Should(Equal("lesson-1.mp3"))
+
+			get("/files?name=lesson&from="+time.Now().Add(-2*time.Hour).Format(time.RFC3339), &result)
+			Ω(result).Should(HaveLen(1))
+			Ω(result[0].FileName).Should(Equal("lesson-2.mp3"))
+		})
+
+		It("pages files", func() {
+			var result []fm.File
+			get("/files?offset=1&limit=1", &result)
+			Ω(result).Should(HaveLen(1))
+			Ω(result[0].FileName).Should(Equal("lesson-2.mp3"))
+		})
+
+		It("rejects bad parameters", func() {
+			var result map[string]string
+			Ω(get("/files?limit=0", &result)).Should(Equal(http.StatusBadRequest))
+			Ω(result["error"]).ShouldNot(BeEmpty())
+		})
+	})
+
+	Describe("GET /files/{id}", func() {
+		It("returns the file", func() {
+			var result fm.File
+			Ω(get("/files/"+files[1].Id, &result)).Should(Equal(http.StatusOK))
+			Ω(result.FileName).Should(Equal("lesson-2.mp3"))
+		})
+
+		It("returns 404 for unknown files", func() {
+			var result map[string]string
+			Ω(get("/files/nope", &result)).Should(Equal(http.StatusNotFound))
+		})
+
+		It("returns the history of the file", func() {
+			var result []fm.FileEvent
+			Ω(get("/files/"+files[0].Id+"/history", &result)).Should(Equal(http.StatusOK))
+			Ω(result).Should(HaveLen(1))
+			Ω(result[0].Action).Should(Equal(fm.EventDetected))
+		})
+
+		It("returns the webhook deliveries of the file", func() {
+			delivery := &fm.WebhookDelivery{FileId: files[0].Id, Event: fm.HookImported, Status: fm.DeliveryDelivered}
+			Ω(store.SaveDelivery(delivery)).Should(Succeed())
+
+			var result []fm.WebhookDelivery
+			Ω(get("/files/"+files[0].Id+"/deliveries", &result)).Should(Equal(http.StatusOK))
+			Ω(result).Should(HaveLen(1))
+			Ω(result[0].Event).Should(Equal(fm.HookImported))
+		})
+	})
+
+	Describe("POST /files/{id}/release", func() {
+		source, target, quarantine := "tmp/api-source", "tmp/api-target", "tmp/api-quarantine"
+
+		AfterEach(func() {
+			for _, dir := range []string{source, target, quarantine} {
+				os.RemoveAll(dir)
+			}
+		})
+
+		It("imports a quarantined file again", func() {
+			os.MkdirAll(source, os.ModePerm)
+			path := source + "/lesson.mp3"
+			Ω(ioutil.WriteFile(path, []byte("lesson"), 0644)).Should(Succeed())
+
+			pair := fm.WatchPair{Source: source, Target: target, Quarantine: quarantine}
+			file, err := fileManager.Import(path, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal("INVALID"))
+
+			var result map[string]string
+			Ω(get("/files/"+file.Id+"/release", &result)).Should(Equal(http.StatusMethodNotAllowed))
+
+			res := do("POST", "/files/"+file.Id+"/release", "")
+			Ω(res.StatusCode).Should(Equal(http.StatusConflict))
+
+			lenient := pair
+			lenient.SkipNaming = true
+			Ω(fileManager.AddWatch(lenient)).Should(Succeed())
+			res = do("POST", "/files/"+file.Id+"/release", "")
+			Ω(res.StatusCode).Should(Equal(http.StatusOK))
+
+			released, _ := fileManager.FindFileById(file.Id)
+			Ω(released.Status).Should(Equal("VALID"))
+			Ω(released.FilePath).Should(Equal(target + "/lesson.mp3"))
+
+			res = do("POST", "/files/"+file.Id+"/release", "")
+			Ω(res.StatusCode).Should(Equal(http.StatusConflict))
+		})
+
+		It("reprocesses an invalid file", func() {
+			os.MkdirAll(source, os.ModePerm)
+			path := source + "/lesson.mp3"
+			Ω(ioutil.WriteFile(path, []byte("lesson"), 0644)).Should(Succeed())
+
+			pair := fm.WatchPair{Source: source, Target: target}
+			file, err := fileManager.Import(path, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal("INVALID"))
+
+			lenient := pair
+			lenient.SkipNaming = true
+			Ω(fileManager.AddWatch(lenient)).Should(Succeed())
+			res := do("POST", "/files/"+file.Id+"/reprocess", "")
+			Ω(res.StatusCode).Should(Equal(http.StatusOK))
+
+			reprocessed, _ := fileManager.FindFileById(file.Id)
+			Ω(reprocessed.Status).Should(Equal("VALID"))
+
+			res = do("POST", "/files/"+file.Id+"/reprocess", "")
+			Ω(res.StatusCode).Should(Equal(http.StatusConflict))
+		})
+	})
+
+	Describe("/watches", func() {
+		source, target := "tmp/api-source", "tmp/api-target"
+
+		AfterEach(func() {
+			os.RemoveAll(source)
+			os.RemoveAll(target)
+		})
+
+		It("adds, lists and removes watch pairs", func() {
+			res := do("POST", "/watches", `{"source": "`+source+`", "target": "`+target+`", "settle": {"duration": "5s"}}`)
+			Ω(res.StatusCode).Should(Equal(http.StatusCreated))
+
+			var pairs []fm.WatchPair
+			Ω(get("/watches", &pairs)).Should(Equal(http.StatusOK))
+			Ω(pairs).Should(HaveLen(1))
+			Ω(pairs[0].Settle.Duration).Should(Equal(5 * time.Second))
+
+			stored, _ := store.ListWatches()
+			Ω(stored).Should(HaveLen(1))
+
+			res = do("POST", "/watches", `{"source": "`+source+`", "target": "other"}`)
+			Ω(res.StatusCode).Should(Equal(http.StatusConflict))
+
+			res = do("DELETE", "/watches?source="+source, "")
+			Ω(res.StatusCode).Should(Equal(http.StatusNoContent))
+			Ω(fileManager.ListWatches()).Should(BeEmpty())
+
+			res = do("DELETE", "/watches?source="+source, "")
+			Ω(res.StatusCode).Should(Equal(http.StatusNotFound))
+		})
+
+		It("rejects invalid watch pairs", func() {
+			res := do("POST", "/watches", `{"source": "`+source+`"}`)
+			Ω(res.StatusCode).Should(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("/jobs", func() {
+		It("lists and retries failed jobs", func() {
+			failed := &fm.Job{Path: "tmp/api-source/lesson.mp3", Status: fm.JobFailed, Attempts: 5, CreatedAt: time.Now()}
+			queued := &fm.Job{Path: "tmp/api-source/song.mp3", Status: fm.JobQueued, CreatedAt: time.Now()}
+			Ω(store.SaveJob(failed)).Should(Succeed())
+			Ω(store.SaveJob(queued)).Should(Succeed())
+
+			var jobs []*fm.Job
+			Ω(get("/jobs?status=failed", &jobs)).Should(Equal(http.StatusOK))
+			Ω(jobs).Should(HaveLen(1))
+			Ω(jobs[0].Id).Should(Equal(failed.Id))
+
+			var job fm.Job
+			Ω(get("/jobs/"+failed.Id+"/retry", &job)).Should(Equal(http.StatusMethodNotAllowed))
+			Ω(do("POST", "/jobs/"+failed.Id+"/retry", "").StatusCode).Should(Equal(http.StatusOK))
+			Ω(do("POST", "/jobs/"+queued.Id+"/retry", "").StatusCode).Should(Equal(http.StatusConflict))
+			Ω(do("POST", "/jobs/nope/retry", "").StatusCode).Should(Equal(http.StatusNotFound))
+
+			retried, _ := fileManager.FindJob(failed.Id)
+			Ω(retried.Status).Should(Equal(fm.JobQueued))
+			Ω(retried.Attempts).Should(BeZero())
+		})
+	})
+
+	Describe("GET /queue", func() {
+		It("returns the queue stats", func() {
+			var result fm.QueueStats
+			Ω(get("/queue", &result)).Should(Equal(http.StatusOK))
+			Ω(result.Workers).Should(BeNumerically(">", 0))
+			Ω(result.Queued).Should(BeZero())
+		})
+	})
+})
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Bnei-Baruch/mms-file-manager/api"
+	"github.com/Bnei-Baruch/mms-file-manager/config"
+	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
+	"github.com/Bnei-Baruch/mms-file-manager/logger"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func serve(args []string) error {
+	flags, dbName := newFlagSet("serve")
+	configFile := flags.String("config", "", "watch configuration file, reloaded on change or SIGHUP")
+	httpAddr := flags.String("http", envOr("HTTP_ADDR", "127.0.0.1:8080"), "address of the API server, changes need API_TOKEN")
+	logMode := flags.String("log", "screen", "where the file manager logs: screen, file or none")
+	parseArgs(flags, args, 0)
+
+	fm.Logger(&logger.LogParams{LogMode: *logMode, LogPrefix: "[FM] "})
+
+	var config []interface{}
+	if *configFile != "" {
+		config = append(config, *configFile)
+	}
+	fileManager, err := fm.NewFM(*dbName, config...)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	stopped := make(chan error, 1)
+	go func() {
+		fmt.Println("API listening on", *httpAddr)
+		stopped <- http.ListenAndServe(*httpAddr, api.NewServer(fileManager, os.Getenv("API_TOKEN")))
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case <-c:
+		fmt.Println("Bye Bye")
+		return nil
+	case err := <-stopped:
+		return fmt.Errorf("API server stopped: %v", err)
+	}
+}
+
+func importFiles(args []string) error {
+	flags, dbName := newFlagSet("import")
+	configFile, target := pairFlags(flags)
+	path := filepath.Clean(parseArgs(flags, args, 1)[0])
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	source := path
+	if !info.IsDir() {
+		source = filepath.Dir(path)
+	}
+	pair, err := findPair(*configFile, *target, source)
+	if err != nil {
+		return err
+	}
+
+	fileManager, err := openConfigFM(*dbName, *configFile)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	if !info.IsDir() {
+		return importFile(fileManager, path, pair)
+	}
+
+	// files are moved away while walking, so they are collected first
+	paths := []string{}
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, p := range paths {
+		if err := importFile(fileManager, p, pair); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(paths))
+	}
+	return nil
+}
+
+func importFile(fileManager fileManager, path string, pair fm.WatchPair) error {
+	file, err := fileManager.Import(path, pair)
+	if file != nil {
+		fmt.Printf("%s\t%s\t%s\n", file.Id, file.Status, file.FilePath)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to import %q: %v", path, err)
+	}
+	return nil
+}
+
+func list(args []string) error {
+	flags, dbName := newFlagSet("list")
+	filter := &fm.FileFilter{}
+	flags.StringVar(&filter.Status, "status", "", "file status, e.g. INVALID")
+	flags.StringVar(&filter.Source, "source", "", "source directory of the watch pair")
+	flags.StringVar(&filter.NameContains, "name", "", "part of the file name")
+	flags.IntVar(&filter.Offset, "offset", 0, "files to skip")
+	flags.IntVar(&filter.Limit, "limit", 100, "maximum number of files, 0 for all")
+	parseArgs(flags, args, 0)
+	filter.Status = strings.ToUpper(filter.Status)
+
+	fileManager, err := openFM(*dbName)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	files, err := fileManager.ListFiles(filter)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tSIZE\tCREATED\tPATH")
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", file.Id, file.Status, file.Size, file.CreatedAt.Format(time.RFC3339), file.FilePath)
+	}
+	return w.Flush()
+}
+
+func show(args []string) error {
+	flags, dbName := newFlagSet("show")
+	name := parseArgs(flags, args, 1)[0]
+
+	fileManager, err := openFM(*dbName)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	file, err := findFile(fileManager, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n\n", data)
+
+	events, err := fileManager.FileHistory(file.Id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tFROM\tTO\tDETAILS\tERROR")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.CreatedAt.Format(time.RFC3339), e.Action, e.From, e.To, e.Details, e.Error)
+	}
+	return w.Flush()
+}
+
+// findFile looks the file up by id, then by name
+func findFile(fileManager fileManager, name string) (*fm.File, error) {
+	file, err := fileManager.FindFileById(name)
+	if err == nil && file == nil {
+		file, err = fileManager.FindOneFile(name)
+	}
+	if err == nil && file == nil {
+		err = fmt.Errorf("file %q not found", name)
+	}
+	return file, err
+}
+
+func reprocess(args []string) error {
+	flags, dbName := newFlagSet("reprocess")
+	configFile, target := pairFlags(flags)
+	id := parseArgs(flags, args, 1)[0]
+
+	fileManager, err := openConfigFM(*dbName, *configFile)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	file, err := fileManager.FindFileById(id)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("file %q not found", id)
+	}
+
+	var pair fm.WatchPair
+	if file.Source != "" {
+		pair, err = findPair(*configFile, *target, file.Source)
+	} else {
+		// records of older versions don't know their source
+		pair, err = findFilePair(*configFile, *target, file.FilePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	file, err = fileManager.Reprocess(id, pair)
+	if file != nil {
+		fmt.Printf("%s\t%s\t%s\n", file.Id, file.Status, file.FilePath)
+	}
+	return err
+}
+
+func release(args []string) error {
+	flags, dbName := newFlagSet("release")
+	configFile, target := pairFlags(flags)
+	quarantine := flags.String("quarantine", "", "quarantine directory, with --target")
+	id := parseArgs(flags, args, 1)[0]
+
+	fileManager, err := openConfigFM(*dbName, *configFile)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	file, err := fileManager.FindFileById(id)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("file %q not found", id)
+	}
+
+	pair, err := findPair(*configFile, *target, file.Source)
+	if err != nil {
+		return err
+	}
+	if *target != "" {
+		pair.Quarantine = *quarantine
+	}
+
+	if file, err = fileManager.Release(id, pair); err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\t%s\n", file.Id, file.Status, file.FilePath)
+	return nil
+}
+
+func jobs(args []string) error {
+	flags, dbName := newFlagSet("jobs")
+	status := flags.String("status", "", "job status, e.g. failed")
+	parseArgs(flags, args, 0)
+
+	fileManager, err := openFM(*dbName)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	jobs, err := fileManager.ListJobs()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tATTEMPTS\tCREATED\tPATH\tERROR")
+	for _, job := range jobs {
+		if *status == "" || job.Status == strings.ToLower(*status) {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", job.Id, job.Status, job.Attempts, job.CreatedAt.Format(time.RFC3339), job.Path, job.Error)
+		}
+	}
+	return w.Flush()
+}
+
+func retry(args []string) error {
+	flags, dbName := newFlagSet("retry")
+	id := parseArgs(flags, args, 1)[0]
+
+	fileManager, err := openFM(*dbName)
+	if err != nil {
+		return err
+	}
+	defer fileManager.Destroy()
+
+	job, err := fileManager.RetryJob(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\t%s\n", job.Id, job.Status, job.Path)
+	return nil
+}
+
+func validateConfig(args []string) error {
+	flags := newCommandFlags("validate-config")
+	configFile := parseArgs(flags, args, 1)[0]
+
+	pairs, err := fm.ReadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		fmt.Printf("%s -> %s\n", pair.Source, pair.Target)
+	}
+	fmt.Printf("%s is valid, %d watch pairs\n", configFile, len(pairs))
+	return nil
+}
+
+func migrate(args []string) error {
+	flags, dbName := newFlagSet("migrate")
+	parseArgs(flags, args, 0)
+
+	if url := os.Getenv("DATABASE_URL"); strings.HasPrefix(url, "memory:") || strings.HasPrefix(url, "bolt://") {
+		fmt.Println("Only RethinkDB stores are migrated, nothing to do")
+		return nil
+	}
+	if err := config.MigrateDB(*dbName); err != nil {
+		return err
+	}
+	fmt.Printf("%s is up to date\n", *dbName)
+	return nil
+}
+
+func pairFlags(flags *flag.FlagSet) (configFile, target *string) {
+	configFile = flags.String("config", "", "take the watch pair of the source directory, the notify and webhook settings from this config file")
+	target = flags.String("target", "", "target directory, instead of a config file")
+	return
+}
+
+// openConfigFM opens the file manager with the notify and webhook settings
+// of configFile, if given. mms serve uses its own when going through the API.
+func openConfigFM(dbName, configFile string) (fileManager, error) {
+	fileManager, err := openFM(dbName)
+	if err != nil || configFile == "" {
+		return fileManager, err
+	}
+	if local, ok := fileManager.(*fm.FileManager); ok {
+		if err = local.ApplyConfig(configFile); err != nil {
+			local.Destroy()
+			return nil, err
+		}
+	}
+	return fileManager, nil
+}
+
+// findPair returns the pair from the config file watching source,
+// or a pair with default settings if target is given
+func findPair(configFile, target, source string) (fm.WatchPair, error) {
+	if target != "" {
+		return fm.WatchPair{Source: source, Target: target}, nil
+	}
+	if configFile == "" {
+		return fm.WatchPair{}, fmt.Errorf("either --config or --target is required")
+	}
+
+	pairs, err := fm.ReadConfig(configFile)
+	if err != nil {
+		return fm.WatchPair{}, err
+	}
+
+	for _, pair := range pairs {
+		if pair.Contains(source) {
+			return pair, nil
+		}
+	}
+	return fm.WatchPair{}, fmt.Errorf("%q is not in a source directory of %s", source, configFile)
+}
+
+// findFilePair returns the pair from the config file watching or delivering
+// to the directory of path. A file in target has no source to go with it.
+func findFilePair(configFile, target, path string) (fm.WatchPair, error) {
+	if target != "" {
+		if pair := (fm.WatchPair{Target: target}); pair.InTarget(path) {
+			return fm.WatchPair{}, fmt.Errorf("the source of %q is unknown, use --config instead of --target", path)
+		}
+		return findPair(configFile, target, filepath.Dir(path))
+	}
+	if configFile == "" {
+		return fm.WatchPair{}, fmt.Errorf("either --config or --target is required")
+	}
+
+	pairs, err := fm.ReadConfig(configFile)
+	if err != nil {
+		return fm.WatchPair{}, err
+	}
+
+	for _, pair := range pairs {
+		if pair.Contains(path) || pair.InTarget(path) {
+			return pair, nil
+		}
+	}
+	return fm.WatchPair{}, fmt.Errorf("%q is not in a source or target directory of %s", path, configFile)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"github.com/Bnei-Baruch/mms-file-manager/logger"
 	r "github.com/dancannon/gorethink"
 	"log"
@@ -12,8 +13,13 @@ var (
 	tables = []struct {
 		name    string
 		options r.TableCreateOpts
+		indexes []string
 	}{
-		{"files", r.TableCreateOpts{PrimaryKey: "file_name"}},
+		{"files", r.TableCreateOpts{PrimaryKey: "id"}, []string{"file_name", "file_path", "created_at", "md5", "sha1", "sha256"}},
+		{"file_events", r.TableCreateOpts{PrimaryKey: "id"}, []string{"file_id"}},
+		{"watches", r.TableCreateOpts{PrimaryKey: "source"}, nil},
+		{"webhook_deliveries", r.TableCreateOpts{PrimaryKey: "id"}, []string{"file_id", "status"}},
+		{"jobs", r.TableCreateOpts{PrimaryKey: "id"}, nil},
 	}
 
 	l *log.Logger = logger.InitLogger(&logger.LogParams{LogMode: "screen", LogPrefix: "[DB] "})
@@ -46,6 +52,22 @@ func InitDB(dbName string) (session *r.Session, err error) {
 
 	for _, table := range tables {
 
+		// a new table would hide the records of a migration cut short
+		var migrating bool
+		cursor, err = r.DB(dbName).TableList().Contains(table.name + "_migration").Run(session)
+		if err != nil {
+			return
+		}
+		defer cursor.Close()
+		if err = cursor.One(&migrating); err != nil {
+			return
+		}
+		if migrating {
+			err = fmt.Errorf("migration of table %s.%s was not finished, run mms migrate again", dbName, table.name)
+			l.Println(err)
+			return
+		}
+
 		cursor, err = r.DB(dbName).TableList().Contains(table.name).Do(func(row r.Term) r.Term {
 			return r.Branch(
 				row.Eq(true),
@@ -58,10 +80,130 @@ func InitDB(dbName string) (session *r.Session, err error) {
 		if err != nil {
 			return
 		}
+
+		// tables created by older versions, e.g. files keyed by file_name,
+		// can't hold the records and must be migrated by hand
+		var primaryKey string
+		cursor, err = r.DB(dbName).Table(table.name).Info().Field("primary_key").Run(session)
+		if err != nil {
+			return
+		}
+		defer cursor.Close()
+		if err = cursor.One(&primaryKey); err != nil {
+			return
+		}
+		if primaryKey != table.options.PrimaryKey {
+			err = fmt.Errorf("table %s.%s has primary key %q instead of %q, run mms migrate first", dbName, table.name, primaryKey, table.options.PrimaryKey)
+			l.Println(err)
+			return
+		}
+
+		for _, index := range table.indexes {
+			cursor, err = r.DB(dbName).Table(table.name).IndexList().Contains(index).Do(func(row r.Term) r.Term {
+				return r.Branch(
+					row.Eq(true),
+					nil,
+					r.DB(dbName).Table(table.name).IndexCreate(index),
+				)
+			}).Run(session)
+			defer cursor.Close()
+
+			if err != nil {
+				return
+			}
+		}
+
+		cursor, err = r.DB(dbName).Table(table.name).IndexWait().Run(session)
+		defer cursor.Close()
+
+		if err != nil {
+			return
+		}
 	}
 
 	return
 }
 
+/*
+ * Moves the records of tables keyed by another primary key than the current
+ * one, e.g. files keyed by file_name, into tables keyed by the current key.
+ * Records are copied into a new table first, which replaces the old one
+ * once all are there. A migration cut short is picked up where it stopped.
+ */
+func MigrateDB(dbName string) error {
+	session, err := r.Connect(r.ConnectOpts{
+		Address:  os.Getenv("RETHINKDB_URL"),
+		Database: dbName,
+		Timeout:  time.Second * 10,
+	})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var existing []string
+	cursor, err := r.DB(dbName).TableList().Run(session)
+	if err != nil {
+		return err
+	}
+	err = cursor.All(&existing)
+	cursor.Close()
+	if err != nil {
+		return err
+	}
+	has := make(map[string]bool)
+	for _, name := range existing {
+		has[name] = true
+	}
+
+	for _, table := range tables {
+		migration := table.name + "_migration"
+		if has[table.name] {
+			var primaryKey string
+			if cursor, err = r.DB(dbName).Table(table.name).Info().Field("primary_key").Run(session); err != nil {
+				return err
+			}
+			err = cursor.One(&primaryKey)
+			cursor.Close()
+			if err != nil {
+				return err
+			}
+			if primaryKey == table.options.PrimaryKey {
+				continue
+			}
+
+			l.Printf("Migrating %s.%s from primary key %q to %q", dbName, table.name, primaryKey, table.options.PrimaryKey)
+			// left over by a migration that failed while copying
+			if has[migration] {
+				if _, err = r.DB(dbName).TableDrop(migration).RunWrite(session); err != nil {
+					return err
+				}
+			}
+			if _, err = r.DB(dbName).TableCreate(migration, table.options).RunWrite(session); err != nil {
+				return err
+			}
+			res, err := r.DB(dbName).Table(migration).Insert(r.DB(dbName).Table(table.name)).RunWrite(session)
+			if err != nil {
+				return err
+			}
+			if res.Errors > 0 {
+				return fmt.Errorf("unable to copy %s.%s: %s", dbName, table.name, res.FirstError)
+			}
+			if _, err = r.DB(dbName).TableDrop(table.name).RunWrite(session); err != nil {
+				return err
+			}
+		} else if !has[migration] {
+			continue
+		}
+
+		// the old table is gone, the copy takes its name
+		if _, err = r.DB(dbName).Table(migration).Config().Update(map[string]interface{}{"name": table.name}).RunWrite(session); err != nil {
+			return err
+		}
+		l.Printf("Migrated %s.%s", dbName, table.name)
+	}
+	return nil
+}
+
 // Drop database should not exist our system
 //func DropDB(dbName string) (session *r.Session, err error) {
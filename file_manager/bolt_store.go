@@ -0,0 +1,471 @@
+package file_manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	filesBucket   = []byte("files")
+	eventsBucket  = []byte("file_events")
+	watchesBucket = []byte("watches")
+	hooksBucket   = []byte("webhook_deliveries")
+	jobsBucket    = []byte("jobs")
+
+	// secondary indexes, keys are "<value>\x00<file id>"
+	fileIndexes = map[string]func(*File) string{
+		"file_name": func(f *File) string { return f.FileName },
+		"file_path": func(f *File) string { return f.FilePath },
+		MD5:         func(f *File) string { return f.Md5 },
+		SHA1:        func(f *File) string { return f.Sha1 },
+		SHA256:      func(f *File) string { return f.Sha256 },
+	}
+)
+
+// boltStore keeps records in an embedded BoltDB file for single host setups.
+// Records are stored as JSON keyed by id, events in a bucket per file.
+type boltStore struct {
+	db   *bolt.DB
+	path string
+}
+
+// BoltDB locks its file, so file managers of the same process share
+// the opened database. It's closed when the last store is closed.
+var boltDBs struct {
+	sync.Mutex
+	dbs  map[string]*bolt.DB
+	refs map[string]int
+}
+
+func init() {
+	boltDBs.dbs = make(map[string]*bolt.DB)
+	boltDBs.refs = make(map[string]int)
+}
+
+// how long NewBoltStore waits for another process to release the file
+const boltLockWait = 10 * time.Second
+
+func NewBoltStore(path string) (FileStore, error) {
+	return newBoltStore(path, boltLockWait)
+}
+
+func newBoltStore(path string, lockWait time.Duration) (FileStore, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	boltDBs.Lock()
+	defer boltDBs.Unlock()
+
+	db, ok := boltDBs.dbs[path]
+	if !ok {
+		if db, err = openBolt(path, lockWait); err != nil {
+			return nil, err
+		}
+		boltDBs.dbs[path] = db
+	}
+	boltDBs.refs[path]++
+
+	return &boltStore{db, path}, nil
+}
+
+func openBolt(path string, lockWait time.Duration) (*bolt.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockWait})
+	if err == bolt.ErrTimeout {
+		return nil, ErrStoreLocked
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, eventsBucket, watchesBucket, hooksBucket, jobsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		for index, value := range fileIndexes {
+			if tx.Bucket(indexBucket(index)) != nil {
+				continue
+			}
+			// added by a later version, filled from the records
+			b, err := tx.CreateBucket(indexBucket(index))
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket(filesBucket).ForEach(func(k, data []byte) error {
+				file := File{}
+				if err := json.Unmarshal(data, &file); err != nil || value(&file) == "" {
+					return err
+				}
+				return b.Put(indexKey(value(&file), file.Id), nil)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func indexBucket(index string) []byte {
+	return []byte("files_by_" + index)
+}
+
+func indexKey(value, id string) []byte {
+	return []byte(value + "\x00" + id)
+}
+
+func (s *boltStore) CreateFile(file *File) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if file.Id == "" {
+			file.Id = newId()
+		} else if tx.Bucket(filesBucket).Get([]byte(file.Id)) != nil {
+			return fmt.Errorf("duplicate primary key %q", file.Id)
+		}
+		return putFile(tx, file, nil)
+	})
+}
+
+// putFile stores file, replacing the index entries of old if given
+func putFile(tx *bolt.Tx, file, old *File) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	for index, value := range fileIndexes {
+		b := tx.Bucket(indexBucket(index))
+		if old != nil && value(old) != "" {
+			if err = b.Delete(indexKey(value(old), old.Id)); err != nil {
+				return err
+			}
+		}
+		if value(file) != "" {
+			if err = b.Put(indexKey(value(file), file.Id), nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(filesBucket).Put([]byte(file.Id), data)
+}
+
+func getFile(tx *bolt.Tx, id string) (*File, error) {
+	data := tx.Bucket(filesBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	file := File{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (s *boltStore) FindFileById(id string) (file *File, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		file, err = getFile(tx, id)
+		return err
+	})
+	return
+}
+
+func (s *boltStore) FindFileByName(fileName string) (*File, error) {
+	files, err := s.findByIndex("file_name", fileName)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+func (s *boltStore) FindFilesByChecksum(algorithm, sum string) ([]*File, error) {
+	if _, ok := fileIndexes[algorithm]; !ok {
+		return nil, fmt.Errorf("unknown checksum %q", algorithm)
+	}
+	return s.findByIndex(algorithm, sum)
+}
+
+func (s *boltStore) FindFilesByPath(filePath string) ([]*File, error) {
+	return s.findByIndex("file_path", filePath)
+}
+
+// findByIndex returns the files with value in index, oldest first
+func (s *boltStore) findByIndex(index, value string) ([]*File, error) {
+	files := []*File{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(value + "\x00")
+		c := tx.Bucket(indexBucket(index)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			file, err := getFile(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if file != nil {
+				files = append(files, file)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(filesByCreation(files))
+	return files, nil
+}
+
+func (s *boltStore) UpdateStatus(file *File, from string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getFile(tx, file.Id)
+		if err != nil {
+			return err
+		}
+		if stored == nil || stored.Status != from {
+			return ErrStatusChanged
+		}
+		return putFile(tx, file, stored)
+	})
+}
+
+func (s *boltStore) ListFiles(filter *FileFilter) ([]*File, error) {
+	files := []*File{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, data []byte) error {
+			file := File{}
+			if err := json.Unmarshal(data, &file); err != nil {
+				return err
+			}
+			if filter.match(&file) {
+				files = append(files, &file)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(filesByCreation(files))
+	return filter.page(files), nil
+}
+
+func (s *boltStore) AddEvent(event *FileEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(eventsBucket).CreateBucketIfNotExists([]byte(event.FileId))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.Id = newId()
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, data)
+	})
+}
+
+func (s *boltStore) FileEvents(fileId string) ([]*FileEvent, error) {
+	events := []*FileEvent{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket).Bucket([]byte(fileId))
+		if b == nil {
+			return nil
+		}
+
+		// keys are big endian sequence numbers, so ForEach goes oldest first
+		return b.ForEach(func(k, data []byte) error {
+			event := FileEvent{}
+			if err := json.Unmarshal(data, &event); err != nil {
+				return err
+			}
+			events = append(events, &event)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *boltStore) SaveWatch(pair *WatchPair) error {
+	data, err := encodeWatch(pair)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchesBucket).Put([]byte(pair.Source), []byte(data))
+	})
+}
+
+func (s *boltStore) DeleteWatch(source string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchesBucket).Delete([]byte(source))
+	})
+}
+
+func (s *boltStore) ListWatches() ([]*WatchPair, error) {
+	pairs := []*WatchPair{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchesBucket).ForEach(func(k, data []byte) error {
+			pair, err := decodeWatch(string(data))
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, pair)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+func (s *boltStore) SaveDelivery(delivery *WebhookDelivery) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if delivery.Id == "" {
+			delivery.Id = newId()
+		}
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(hooksBucket).Put([]byte(delivery.Id), data)
+	})
+}
+
+func (s *boltStore) ClaimDelivery(delivery *WebhookDelivery, from string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hooksBucket)
+		data := bucket.Get([]byte(delivery.Id))
+		if data == nil {
+			return ErrDeliveryClaimed
+		}
+		stored := WebhookDelivery{}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		if stored.Claim != from {
+			return ErrDeliveryClaimed
+		}
+
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(delivery.Id), data)
+	})
+}
+
+func (s *boltStore) PendingDeliveries() ([]*WebhookDelivery, error) {
+	return s.findDeliveries(func(d *WebhookDelivery) bool { return d.Status == DeliveryPending })
+}
+
+func (s *boltStore) FileDeliveries(fileId string) ([]*WebhookDelivery, error) {
+	return s.findDeliveries(func(d *WebhookDelivery) bool { return d.FileId == fileId })
+}
+
+// findDeliveries scans the log, it's expected to stay small
+func (s *boltStore) findDeliveries(match func(*WebhookDelivery) bool) ([]*WebhookDelivery, error) {
+	deliveries := []*WebhookDelivery{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hooksBucket).ForEach(func(k, data []byte) error {
+			delivery := WebhookDelivery{}
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+			if match(&delivery) {
+				deliveries = append(deliveries, &delivery)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(deliveriesByCreation(deliveries))
+	return deliveries, nil
+}
+
+func (s *boltStore) SaveJob(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if job.Id == "" {
+			job.Id = newId()
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).Put([]byte(job.Id), data)
+	})
+}
+
+func (s *boltStore) DeleteJob(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) ListJobs() ([]*Job, error) {
+	jobs := []*Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, data []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(data, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, &job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(jobsByCreation(jobs))
+	return jobs, nil
+}
+
+func (s *boltStore) Close() error {
+	boltDBs.Lock()
+	defer boltDBs.Unlock()
+
+	if boltDBs.refs[s.path]--; boltDBs.refs[s.path] > 0 {
+		return nil
+	}
+	delete(boltDBs.refs, s.path)
+	delete(boltDBs.dbs, s.path)
+	return s.db.Close()
+}
@@ -0,0 +1,120 @@
+package file_manager
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	MD5    = "md5"
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+)
+
+var defaultChecksums = []string{SHA1}
+
+var hashes = map[string]func() hash.Hash{
+	MD5:    md5.New,
+	SHA1:   sha1.New,
+	SHA256: sha256.New,
+}
+
+func validateChecksums(algorithms []string, source string) error {
+	for _, algorithm := range algorithms {
+		if _, ok := hashes[algorithm]; !ok {
+			return fmt.Errorf("unknown checksum %q for %q", algorithm, source)
+		}
+	}
+	return nil
+}
+
+// computeChecksums reads path once and returns its size and
+// a hex encoded sum for every algorithm.
+func computeChecksums(path string, algorithms []string) (size int64, sums map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	hs := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		newHash, ok := hashes[algorithm]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown checksum %q", algorithm)
+		}
+		hs[algorithm] = newHash()
+		writers = append(writers, hs[algorithm])
+	}
+
+	if size, err = io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return 0, nil, err
+	}
+
+	sums = make(map[string]string, len(hs))
+	for algorithm, h := range hs {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return size, sums, nil
+}
+
+func (file *File) setChecksums(size int64, sums map[string]string) {
+	file.Size = size
+	file.Md5 = sums[MD5]
+	file.Sha1 = sums[SHA1]
+	file.Sha256 = sums[SHA256]
+}
+
+func (file *File) checksums() map[string]string {
+	sums := make(map[string]string)
+	for algorithm, sum := range map[string]string{MD5: file.Md5, SHA1: file.Sha1, SHA256: file.Sha256} {
+		if sum != "" {
+			sums[algorithm] = sum
+		}
+	}
+	return sums
+}
+
+// checksumDetails formats size and sums for the file history
+func (file *File) checksumDetails() string {
+	details := []string{fmt.Sprintf("size:%d", file.Size)}
+	for algorithm, sum := range file.checksums() {
+		details = append(details, algorithm+":"+sum)
+	}
+	sort.Strings(details[1:])
+	return strings.Join(details, " ")
+}
+
+// verifyChecksums recomputes the sums recorded on file against
+// the content found at path.
+func (file *File) verifyChecksums(path string) error {
+	expected := file.checksums()
+	algorithms := make([]string, 0, len(expected))
+	for algorithm := range expected {
+		algorithms = append(algorithms, algorithm)
+	}
+
+	size, sums, err := computeChecksums(path, algorithms)
+	if err != nil {
+		return err
+	}
+
+	if size != file.Size {
+		return fmt.Errorf("size mismatch for %q: expected %d, got %d", path, file.Size, size)
+	}
+	for algorithm, sum := range expected {
+		if sums[algorithm] != sum {
+			return fmt.Errorf("%s mismatch for %q: expected %s, got %s", algorithm, path, sum, sums[algorithm])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package file_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// What happens when the name of a file is taken in the target
+const (
+	// Keep both, the file gets a _1, _2... suffix (default)
+	ConflictRename = "rename"
+	// Fail the file, so it goes to quarantine
+	ConflictFail = "fail"
+	// Replace the file in the target if it has the same content,
+	// fail otherwise
+	ConflictOverwrite = "overwrite"
+	// Move the file in the target into a .versions directory next to it
+	ConflictVersion = "version"
+)
+
+const versionsDir = ".versions"
+
+func validateConflict(policy, source string) error {
+	switch policy {
+	case "", ConflictRename, ConflictFail, ConflictOverwrite, ConflictVersion:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy %q for %q", policy, source)
+	}
+}
+
+func (pair *WatchPair) conflict() string {
+	if pair.Conflict == "" {
+		return ConflictRename
+	}
+	return pair.Conflict
+}
+
+// ConflictError is returned when a file can't take a name in the target.
+// Conflicts aren't retried, see failOrRetry.
+type ConflictError struct {
+	Path   string
+	Reason string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%q is taken by another file, %s", e.Path, e.Reason)
+}
+
+/*
+ * Claims path in the target for the file following the pair's conflict
+ * policy. Returns where the file goes and whether that path is reserved by
+ * an empty file. The policy applied to a taken name is recorded on d.
+ */
+func (fm *FileManager) claimTarget(file *File, pair *WatchPair, path string, d *TargetDelivery) (target string, reserved bool, err error) {
+	// no policy gets a directory out of the way
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return "", false, fmt.Errorf("target %q is a directory", path)
+	}
+
+	policy := pair.conflict()
+	if policy == ConflictRename {
+		if target, err = reservePath(path); target != path {
+			d.Conflict = policy
+		}
+		return target, err == nil, err
+	}
+
+	if reserved, err = reserve(path); reserved || err != nil {
+		return path, reserved, err
+	}
+
+	d.Conflict = policy
+	switch policy {
+	case ConflictOverwrite:
+		if err = file.verifyChecksums(path); err != nil {
+			return "", false, &ConflictError{path, fmt.Sprintf("not overwriting it: %v", err)}
+		}
+		return path, false, nil
+	case ConflictVersion:
+		if d.Version, err = fm.versionFile(path); err != nil {
+			return "", false, err
+		}
+		if reserved, err = reserve(path); err == nil && !reserved {
+			err = fmt.Errorf("%q was taken again", path)
+		}
+		return path, reserved, err
+	default:
+		return "", false, &ConflictError{path, "failing"}
+	}
+}
+
+// versionFile moves the file at path into the versions directory next to
+// it and returns its new path
+func (fm *FileManager) versionFile(path string) (string, error) {
+	dir := filepath.Join(filepath.Dir(path), versionsDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	version, err := reservePath(filepath.Join(dir, filepath.Base(path)))
+	if err != nil {
+		return "", err
+	}
+	if err = fm.moveFile(nil, path, version); err != nil {
+		os.Remove(version)
+		return "", fmt.Errorf("unable to version %q: %v", path, err)
+	}
+
+	l.Printf("Versioned %q to %q", path, version)
+	fm.recordVersion(path, version)
+	return version, nil
+}
+
+// recordVersion points the record of the versioned file, if any, to the
+// versions directory
+func (fm *FileManager) recordVersion(from, to string) {
+	files, err := fm.store.FindFilesByPath(from)
+	if err != nil {
+		l.Printf("Unable to find the record of %q: %v", from, err)
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	// the last file imported to the path is the one there
+	f := files[len(files)-1]
+	f.FilePath = to
+	err = fm.store.UpdateStatus(f, f.Status)
+	fm.logMove(f, from, to, ConflictVersion, err)
+	if err != nil {
+		l.Printf("Unable to record the version of %q: %v", from, err)
+	}
+}
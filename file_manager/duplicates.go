@@ -0,0 +1,131 @@
+package file_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Import duplicates as new versions linked to the original (default)
+	DuplicateVersion = "version"
+	// Delete the incoming copy
+	DuplicateSkip = "skip"
+	// Move the incoming copy to the duplicates directory
+	DuplicateQuarantine = "quarantine"
+)
+
+type DuplicatePolicy struct {
+	Policy string `yaml:"policy" json:"policy"`
+	Dir    string `yaml:"dir" json:"dir"`
+}
+
+func (p *DuplicatePolicy) validate(source string) error {
+	switch p.Policy {
+	case "", DuplicateVersion, DuplicateSkip:
+	case DuplicateQuarantine:
+		if p.Dir == "" {
+			return fmt.Errorf("duplicates dir is required by %q policy of %q", p.Policy, source)
+		}
+	default:
+		return fmt.Errorf("unknown duplicates policy %q for %q", p.Policy, source)
+	}
+	return nil
+}
+
+/*
+ * Looks for records with the same content as file and applies the policy.
+ * Returns true if the incoming file was taken care of and must not be imported.
+ */
+func (fm *FileManager) resolveDuplicate(file *File, policy *DuplicatePolicy) (bool, error) {
+	copies, err := fm.findSameContent(file)
+	if err != nil || len(copies) == 0 {
+		return false, err
+	}
+
+	original := copies[0]
+	for _, f := range copies {
+		if f.OriginalId == "" {
+			original = f
+			break
+		}
+	}
+
+	switch policy.Policy {
+	case DuplicateSkip:
+		// a failed or invalid copy may be gone, the incoming one is kept then
+		kept := deliveredCopy(copies)
+		if kept == nil {
+			break
+		}
+		l.Printf("Skipping %q, same content as %q", file.FilePath, kept.FilePath)
+		if err = fm.recordDuplicate(file, kept, len(copies)+1); err != nil {
+			return false, err
+		}
+		err = os.Remove(file.FilePath)
+		fm.logEvent(file, EventSkipped, file.FilePath, "", file.Error, err)
+		if err != nil {
+			return false, err
+		}
+		fm.logEvent(file, EventDeleted, file.FilePath, "", file.Error, nil)
+		return true, nil
+	case DuplicateQuarantine:
+		if err = os.MkdirAll(policy.Dir, os.ModePerm); err != nil {
+			return false, err
+		}
+		target, err := reservePath(filepath.Join(policy.Dir, file.FileName))
+		if err != nil {
+			return false, err
+		}
+		if err = fm.recordDuplicate(file, original, len(copies)+1); err != nil {
+			os.Remove(target)
+			return false, err
+		}
+		l.Printf("Quarantining %q to %q, same content as %q", file.FilePath, target, original.FilePath)
+		from := file.FilePath
+		err = fm.moveFile(file, from, target)
+		fm.logMove(file, from, target, file.Error, err)
+		if err != nil {
+			os.Remove(target)
+			return false, err
+		}
+		file.FilePath = target
+		if err = fm.store.UpdateStatus(file, file.Status); err != nil {
+			l.Printf("Unable to save quarantined path of %s: %v", file.FileName, err)
+		}
+		return true, nil
+	}
+
+	file.OriginalId = original.Id
+	file.Version = len(copies) + 1
+	return false, nil
+}
+
+// recordDuplicate records the incoming copy as an invalid version of
+// original, so its history tells where it went
+func (fm *FileManager) recordDuplicate(file, original *File, version int) error {
+	file.OriginalId = original.Id
+	file.Version = version
+	file.Status = FileStatuses[InvalidFile]
+	file.Error = "duplicate of " + original.Id
+	return fm.insertFile(file)
+}
+
+// deliveredCopy returns the first of copies that is valid or was delivered
+// to a target, or nil if none is
+func deliveredCopy(copies []*File) *File {
+	for _, f := range copies {
+		switch f.Status {
+		case FileStatuses[ValidFile], FileStatuses[PublishedFile], FileStatuses[ArchivedFile]:
+			return f
+		case FileStatuses[InvalidFile], FileStatuses[FailedFile]:
+			continue
+		}
+		for _, d := range f.Deliveries {
+			if d.Status == DeliveryDelivered {
+				return f
+			}
+		}
+	}
+	return nil
+}
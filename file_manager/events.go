@@ -0,0 +1,78 @@
+package file_manager
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileEvent is an entry of the append-only audit trail kept per file
+type FileEvent struct {
+	Id        string    `gorethink:"id,omitempty" json:"id,omitempty"`
+	FileId    string    `gorethink:"file_id" json:"file_id"`
+	Action    string    `gorethink:"action" json:"action"`
+	From      string    `gorethink:"from,omitempty" json:"from,omitempty"`
+	To        string    `gorethink:"to,omitempty" json:"to,omitempty"`
+	Details   string    `gorethink:"details,omitempty" json:"details,omitempty"`
+	Error     string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	Host      string    `gorethink:"host" json:"host"`
+	CreatedAt time.Time `gorethink:"created_at" json:"created_at"`
+}
+
+const (
+	EventDetected    = "detected"
+	EventChecksum    = "checksum"
+	EventStatus      = "status"
+	EventMoved       = "moved"
+	EventRenamed     = "renamed"
+	EventValidated   = "validated"
+	EventDeleted     = "deleted"
+	EventSkipped     = "skipped"
+	EventQuarantined = "quarantined"
+	EventNotified    = "notified"
+)
+
+var hostName, _ = os.Hostname()
+
+// Appends an event to the history of file. Failing to write history
+// must never stop the import, so errors are only logged.
+func (fm *FileManager) logEvent(file *File, action, from, to, details string, err error) {
+	event := FileEvent{
+		FileId:    file.Id,
+		Action:    action,
+		From:      from,
+		To:        to,
+		Details:   details,
+		Host:      hostName,
+		CreatedAt: time.Now(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if err := fm.store.AddEvent(&event); err != nil {
+		l.Println("Create file event issue", err)
+	}
+
+	if hook := hookEvent(action, to); hook != "" && err == nil {
+		fm.dispatcher.enqueue(file, hook, details)
+	}
+}
+
+// logMove logs the move of file and, if it got another name on the way,
+// the rename
+func (fm *FileManager) logMove(file *File, from, to, details string, err error) {
+	fm.logEvent(file, EventMoved, from, to, details, err)
+	if err == nil && filepath.Base(from) != filepath.Base(to) {
+		fm.logEvent(file, EventRenamed, filepath.Base(from), filepath.Base(to), details, nil)
+	}
+}
+
+// FileHistory returns the events recorded for the file, oldest first
+func (fm *FileManager) FileHistory(fileId string) ([]*FileEvent, error) {
+	events, err := fm.store.FileEvents(fileId)
+	if err != nil {
+		l.Println(err)
+	}
+	return events, err
+}
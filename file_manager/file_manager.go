@@ -1,7 +1,6 @@
 package file_manager
 
 import (
-	"github.com/Bnei-Baruch/mms-file-manager/config"
 	"github.com/Bnei-Baruch/mms-file-manager/logger"
 
 	"fmt"
@@ -9,53 +8,178 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
 type updateMsg struct {
-	file, targetDir string
+	file string
+	pair *WatchPair
+	job  *Job
 }
 
+// fileCacher holds the paths handed over by the watchers, so files waiting
+// or being imported aren't taken twice
 type fileCacher map[string]updateMsg
 
 var (
 	watchDirCacher struct {
 		sync.Mutex
-		cache map[string]*FileManager
+		cache map[string]*dirWatcher
 	}
-	l *log.Logger = nil
+	// discards until Logger is called
+	l *log.Logger = logger.InitLogger(&logger.LogParams{LogPrefix: "[FM] "})
 )
 
 type FileManager struct {
-	updates  chan updateMsg
-	done     chan bool
-	services *config.Services
+	updates    chan updateMsg
+	wake       chan bool
+	pool       *pool
+	done       chan bool
+	store      FileStore
+	notifier   *notifier
+	dispatcher *dispatcher
+	// the state monitor and its handlers, waited for by Destroy
+	workers sync.WaitGroup
+
+	// pairs of the config file by source, see ReloadConfig
+	configFile  string
+	configPairs map[string]WatchPair
+	configLock  sync.Mutex
 }
 
-type watchPair map[string]string
-type watchPairs []watchPair
+type WatchPair struct {
+	Source string `yaml:"source" json:"source"`
+	Target string `yaml:"target" json:"target"`
+
+	// Watcher selects how the source directory is watched: "notify" (default)
+	// uses inotify/kqueue events, "poll" re-walks the directory every
+	// PollInterval. Use "poll" for network mounts where events don't fire.
+	Watcher        string        `yaml:"watcher" json:"watcher"`
+	PollInterval   time.Duration `yaml:"poll_interval" json:"poll_interval"`
+	RescanInterval time.Duration `yaml:"rescan_interval" json:"rescan_interval"`
+
+	Settle SettlePolicy `yaml:"settle" json:"settle"`
+
+	// Checksums computed while importing: md5, sha1 and/or sha256.
+	// Defaults to sha1.
+	Checksums []string `yaml:"checksums" json:"checksums"`
+
+	Duplicates DuplicatePolicy `yaml:"duplicates" json:"duplicates"`
+
+	// Layout of the target directory: "flatten" (default) or "mirror"
+	// to keep subdirectories of the source.
+	Layout string `yaml:"layout" json:"layout"`
+
+	// Path of the file in the target as a text/template, overrides Layout.
+	// See targetFields for the available fields.
+	TargetTemplate string `yaml:"target_template" json:"target_template"`
+
+	// Files whose names don't follow the naming convention are marked
+	// invalid unless set
+	SkipNaming bool `yaml:"skip_naming" json:"skip_naming"`
+
+	// Invalid and failed files are moved here with a sidecar explaining
+	// why, see Release. They stay where they are if not set.
+	Quarantine string `yaml:"quarantine" json:"quarantine"`
+
+	Media MediaRules `yaml:"media" json:"media"`
+
+	// Notified of invalid and failed files besides the recipients
+	// of NotifyConfig
+	Notify []string `yaml:"notify" json:"notify"`
+
+	// Files of the pair imported at the same time, only the limit
+	// of PoolConfig applies if 0
+	Workers int `yaml:"workers" json:"workers"`
+
+	// How files get to the targets: "move" (default), "copy" or "hardlink",
+	// see ModeMove
+	Mode string `yaml:"mode" json:"mode"`
+	// Targets besides Target, files are validated in Target only
+	Targets []PairTarget `yaml:"targets" json:"targets"`
+
+	// What happens when a name is taken in a target: "rename" (default),
+	// "fail", "overwrite" or "version", see ConflictRename
+	Conflict string `yaml:"conflict" json:"conflict"`
+
+	Retry RetryPolicy `yaml:"retry" json:"retry"`
+}
+
+type watchPairs []WatchPair
+
+type pairsBySource []WatchPair
+
+func (p pairsBySource) Len() int           { return len(p) }
+func (p pairsBySource) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pairsBySource) Less(i, j int) bool { return p[i].Source < p[j].Source }
+
+// WatchError is returned when a directory is already watched,
+// or when it's not watched by the file manager but should be.
+type WatchError struct {
+	Source  string
+	Watched bool
+}
+
+func (e *WatchError) Error() string {
+	if e.Watched {
+		return fmt.Sprintf("Directory %q is already watched", e.Source)
+	}
+	return fmt.Sprintf("Directory %q is not watched", e.Source)
+}
 
 func Logger(params *logger.LogParams) {
 	l = logger.InitLogger(params)
 }
 
 func init() {
-	watchDirCacher.cache = make(map[string]*FileManager)
+	watchDirCacher.cache = make(map[string]*dirWatcher)
 }
 
 /*
- * 1. Initialize File manager.
- * 2. Starts watching files if config is supplied.
+ * 1. Opens the store selected by DATABASE_URL, see OpenStore.
+ * 2. Initialize File manager.
+ * 3. Starts watching files if config is supplied and reloads it on change,
+ *    see ReloadConfig.
  */
-func NewFM(dbName string, configFile ...interface{}) (fm *FileManager, err error) {
-	fm = &FileManager{
-		updates:  make(chan updateMsg, 1),
-		done:     make(chan bool),
-		services: config.NewServices(dbName),
+func NewFM(dbName string, configFile ...interface{}) (*FileManager, error) {
+	store, err := OpenStore(dbName)
+	if err != nil {
+		return nil, err
+	}
+	return NewFMWithStore(store, configFile...)
+}
+
+// Opens the store selected by DATABASE_URL without watching anything,
+// for one-off commands next to a running file manager. A BoltDB file held
+// by another process isn't waited for, ErrStoreLocked is returned instead.
+func OpenFM(dbName string) (*FileManager, error) {
+	store, err := openStore(dbName, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return newFileManager(store), nil
+}
+
+func newFileManager(store FileStore) *FileManager {
+	fm := &FileManager{
+		updates: make(chan updateMsg, 1),
+		wake:    make(chan bool, 1),
+		pool:    newPool(),
+		done:    make(chan bool),
+		store:   store,
 	}
+	fm.notifier = &notifier{fm: fm, pending: make(map[string][]notice)}
+	fm.dispatcher = newDispatcher(fm)
+	return fm
+}
+
+// Same as NewFM but uses the given store. The store is closed on Destroy.
+func NewFMWithStore(store FileStore, configFile ...interface{}) (fm *FileManager, err error) {
+	fm = newFileManager(store)
 	fm.stateMonitor(2 * time.Second)
+	fm.dispatcher.start()
 
 	// this will recover all panic and destroy appropriate assets
 	defer func() {
@@ -66,32 +190,50 @@ func NewFM(dbName string, configFile ...interface{}) (fm *FileManager, err error
 		}
 	}()
 
-	//TODO: should do something with logger
-	if l == nil {
-		l = logger.InitLogger(&logger.LogParams{LogPrefix: "[FM] "})
-	}
-
 	if configFile != nil {
-		if watch, err := readConfigFile(configFile[0]); err != nil {
-			panic(fmt.Errorf("unable to read config file: %v", err))
-		} else {
-			if watch == nil {
-				panic(fmt.Errorf("%q key not found in config file", "watch"))
-			}
-			for _, pair := range watch {
-				l.Println("Starting to watch: ", pair["source"], pair["target"])
-				if err := fm.Watch(pair["source"], pair["target"]); err != nil {
-					panic(fmt.Errorf("unable to watch %q: %v", pair["source"], err))
-				}
+		config, err := loadConfig(configFile[0])
+		if err != nil {
+			panic(err)
+		}
+		if err := fm.SetNotify(config.Notify); err != nil {
+			panic(err)
+		}
+		if err := fm.SetWebhooks(config.Webhooks); err != nil {
+			panic(err)
+		}
+		if err := fm.SetPool(config.Pool); err != nil {
+			panic(err)
+		}
+
+		fm.configPairs = make(map[string]WatchPair)
+		for _, pair := range config.Watch {
+			l.Println("Starting to watch: ", pair.Source, pair.Target)
+			if err := fm.AddWatch(pair); err != nil {
+				panic(fmt.Errorf("unable to watch %q: %v", pair.Source, err))
 			}
+			fm.configPairs[pair.Source] = pair
 		}
 
+		fm.configFile = configFile[0].(string)
+		fm.watchConfig()
+	}
+
+	if err := fm.restoreWatches(); err != nil {
+		panic(fmt.Errorf("unable to restore watches: %v", err))
 	}
 	return
 }
 
-func readConfigFile(configFile interface{}) (watch watchPairs, err error) {
-	yml := make(map[string]watchPairs)
+// configData is the content of the config file
+type configData struct {
+	Watch    watchPairs   `yaml:"watch"`
+	Notify   NotifyConfig `yaml:"notify"`
+	Webhooks []Webhook    `yaml:"webhooks"`
+	Pool     PoolConfig   `yaml:"pool"`
+}
+
+func readConfigFile(configFile interface{}) (yml *configData, err error) {
+	yml = &configData{}
 	l.Println("Reading custom configuration file", configFile)
 	if configFileName, ok := configFile.(string); ok {
 		var file []byte
@@ -99,110 +241,354 @@ func readConfigFile(configFile interface{}) (watch watchPairs, err error) {
 		if file, err = ioutil.ReadFile(configFileName); err != nil {
 			return nil, err
 		}
-		if err = yaml.Unmarshal(file, &yml); err != nil {
+		if err = yaml.Unmarshal(file, yml); err != nil {
 			return nil, err
 		}
 	} else {
 		return nil, fmt.Errorf("File name should be string")
 	}
 
-	return yml["watch"], nil
+	return yml, nil
 }
 
+/*
+ * Stops the watches and waits for the running imports, the pending notices
+ * and webhook senders before the store is closed. Queued files are left to
+ * the next start, see replayJobs.
+ */
 func (fm *FileManager) Destroy() {
+	fm.configLock.Lock()
 	close(fm.done)
-	watchDirCacher.Lock()
-	defer watchDirCacher.Unlock()
+	fm.configLock.Unlock()
 
+	watchDirCacher.Lock()
 	for key, value := range watchDirCacher.cache {
-		if value == fm {
+		if value.fm == fm {
+			close(value.stop)
 			delete(watchDirCacher.cache, key)
 		}
 	}
+	watchDirCacher.Unlock()
 
-	fm.services.Destroy()
+	// running imports still write to the store and may notify
+	fm.workers.Wait()
+	fm.notifier.close()
+	fm.dispatcher.halt()
+	fm.store.Close()
 }
 
 func (fm *FileManager) Watch(watchDir, targetDir string) error {
+	return fm.AddWatch(WatchPair{Source: watchDir, Target: targetDir})
+}
+
+func (fm *FileManager) AddWatch(pair WatchPair) error {
+	if err := pair.validate(); err != nil {
+		return err
+	}
+
 	watchDirCacher.Lock()
 	defer watchDirCacher.Unlock()
 
-	if _, ok := watchDirCacher.cache[watchDir]; ok {
-		l.Println("############!!!Directory %s is already watched", watchDir)
-		return fmt.Errorf("Directory %q is already watched", watchDir)
+	if _, ok := watchDirCacher.cache[pair.Source]; ok {
+		l.Printf("############!!!Directory %s is already watched", pair.Source)
+		return &WatchError{pair.Source, true}
 	}
-	watchDirCacher.cache[watchDir] = fm
 
-	if err := os.MkdirAll(watchDir, os.ModePerm); err != nil {
+	if err := os.MkdirAll(pair.Source, os.ModePerm); err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+	if err := pair.makeTargets(); err != nil {
 		return err
 	}
-	go fm.watch(watchDir, targetDir)
+
+	w := newDirWatcher(fm, &pair)
+	watchDirCacher.cache[pair.Source] = w
+	w.start()
+	return nil
+}
+
+// Same as AddWatch but also stores the pair, so it's watched again
+// when a file manager is created with the same store.
+func (fm *FileManager) AddStoredWatch(pair WatchPair) error {
+	if err := fm.AddWatch(pair); err != nil {
+		return err
+	}
+
+	if err := fm.store.SaveWatch(&pair); err != nil {
+		l.Printf("Unable to store watch pair %q: %v", pair.Source, err)
+		fm.Unwatch(pair.Source)
+		return err
+	}
+	return nil
+}
+
+// Stops watching source and removes it from the store. Files already
+// handed over to the state monitor are still imported.
+func (fm *FileManager) Unwatch(source string) error {
+	if err := fm.stopWatch(source); err != nil {
+		return err
+	}
+	return fm.store.DeleteWatch(source)
+}
+
+func (fm *FileManager) stopWatch(source string) error {
+	watchDirCacher.Lock()
+	w, ok := watchDirCacher.cache[source]
+	if !ok || w.fm != fm {
+		watchDirCacher.Unlock()
+		return &WatchError{source, false}
+	}
+	delete(watchDirCacher.cache, source)
+	watchDirCacher.Unlock()
+
+	w.halt()
+	l.Println("Stopped watching", source)
 	return nil
 }
 
+// Returns the pairs watched by this file manager ordered by source
+func (fm *FileManager) ListWatches() []WatchPair {
+	watchDirCacher.Lock()
+	defer watchDirCacher.Unlock()
+
+	pairs := []WatchPair{}
+	for _, w := range watchDirCacher.cache {
+		if w.fm == fm {
+			pairs = append(pairs, *w.pair)
+		}
+	}
+	sort.Sort(pairsBySource(pairs))
+	return pairs
+}
+
+// Contains reports whether path is inside the source of the pair
+func (pair *WatchPair) Contains(path string) bool {
+	return isWithin(pair.Source, path)
+}
+
+// InTarget reports whether path is inside one of the targets of the pair
+func (pair *WatchPair) InTarget(path string) bool {
+	for _, dir := range pair.targetDirs() {
+		if isWithin(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the pair watching source
+func (fm *FileManager) WatchedPair(source string) (WatchPair, bool) {
+	watchDirCacher.Lock()
+	defer watchDirCacher.Unlock()
+
+	if w, ok := watchDirCacher.cache[source]; ok && w.fm == fm {
+		return *w.pair, true
+	}
+	return WatchPair{}, false
+}
+
+// Starts watching the pairs saved by AddStoredWatch. Pairs that can't be
+// watched, e.g. because the config file watches them too, are skipped.
+func (fm *FileManager) restoreWatches() error {
+	pairs, err := fm.store.ListWatches()
+	if err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		l.Println("Restoring watch: ", pair.Source, pair.Target)
+		if err := fm.AddWatch(*pair); err != nil {
+			l.Printf("Unable to restore watch %q: %v", pair.Source, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Queues the files handed over by the watchers and imports them on a bounded
+ * number of workers, see PoolConfig. While the queue is full updates aren't
+ * taken, so the watchers wait. Jobs that failed an attempt wait in the
+ * backlog for the next one, see RetryPolicy.
+ */
 func (fm *FileManager) stateMonitor(updateInterval time.Duration) {
-	fc := make(fileCacher)
+	b := newBacklog()
 	ticker := time.NewTicker(updateInterval)
-	var wg sync.WaitGroup
+	finished := make(chan updateMsg)
+	retry := time.NewTimer(0)
+
+	fm.replayJobs(b)
 
+	fm.workers.Add(1)
 	go func() {
+		defer fm.workers.Done()
+		defer ticker.Stop()
+		defer func() { retry.Stop() }()
 		for {
+			// a nil channel is never ready
+			updates := fm.updates
+			if fm.pool.full() {
+				updates = nil
+			}
+
 			select {
 			case <-fm.done:
 				l.Println("Exiting stateMonitor")
-				wg.Wait()
 				return
 			case <-ticker.C:
-				logState(&fc)
-			case u := <-fm.updates:
-				if _, ok := fc[u.file]; !ok {
-					fc[u.file] = u
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-						fm.handler(u)
-					}()
+				fm.logState()
+				fm.requeue(b)
+			case <-fm.wake:
+				fm.requeue(b)
+			case <-retry.C:
+			case u := <-updates:
+				if _, ok := b.files[u.file]; !ok {
+					fm.queueJob(&u)
+					b.files[u.file] = u
+					fm.pool.push(u)
 				}
+			case u := <-finished:
+				fm.pool.finish(u)
+				b.finish(u)
+			}
+
+			now := time.Now()
+			for _, u := range b.due(now) {
+				fm.pool.push(u)
+			}
+			retry.Stop()
+			if next, ok := b.next(); ok {
+				retry = time.NewTimer(next.Sub(now))
+			}
+
+			for u, ok := fm.pool.next(); ok; u, ok = fm.pool.next() {
+				fm.workers.Add(1)
+				go func(u updateMsg) {
+					defer fm.workers.Done()
+					fm.handler(u)
+					select {
+					case finished <- u:
+					case <-fm.done:
+					}
+				}(u)
 			}
 		}
 	}()
 }
 
-func logState(fc *fileCacher) {
-	l.Println("Current state:")
-	for k, v := range *fc {
-		l.Printf(" %s %s\n", k, v.targetDir)
+func (fm *FileManager) wakeMonitor() {
+	select {
+	case fm.wake <- true:
+	default:
+	}
+}
+
+func (fm *FileManager) logState() {
+	stats := fm.QueueStats()
+	if stats.Queued == 0 && stats.Running == 0 {
+		return
+	}
+	l.Printf("Current state: %d queued, %d running", stats.Queued, stats.Running)
+	for source, pair := range stats.Pairs {
+		l.Printf(" %s: %d queued, %d running", source, pair.Queued, pair.Running)
 	}
 }
 
 func (fm *FileManager) handler(u updateMsg) {
-	fileName := filepath.Base(u.file)
-	os.Rename(u.file, filepath.Join(u.targetDir, fileName))
-	if _, err := fm.CreateFileRecord(u.file); err != nil {
-		//l.Panic(err)
+	if err := fm.runJob(u); err != nil {
+		l.Printf("Unable to import %q: %v", u.file, err)
+	}
+}
+
+// importFile records the file at path and delivers it to the pair's target,
+// recording the progress on job if given
+func (fm *FileManager) importFile(path string, pair *WatchPair, job *Job) (*File, error) {
+	file, err := newFile(path, pair.checksumAlgorithms())
+	if err != nil {
+		return nil, err
+	}
+	file.Source = pair.Source
+	file.job = job
+
+	if kept, err := fm.findDelivered(file, pair); err != nil {
+		return nil, &TransientError{err}
+	} else if kept != nil {
+		l.Printf("Skipping %q, imported already as %s", path, kept.Id)
+		return kept, nil
 	}
 
+	if handled, err := fm.resolveDuplicate(file, &pair.Duplicates); err != nil {
+		return nil, fmt.Errorf("unable to handle duplicate: %v", err)
+	} else if handled {
+		return file, nil
+	}
+
+	if err = fm.insertFile(file); err != nil {
+		return nil, &TransientError{err}
+	}
+	if job != nil {
+		job.FileId = file.Id
+		fm.saveJob(job)
+	}
+
+	// the watcher only hands over settled files
+	if err = fm.Transition(file, StableFile); err != nil {
+		return file, err
+	}
+	return file, fm.deliver(file, pair)
 }
 
-func (fm *FileManager) watch(watchDir, targetDir string) {
-	for {
-		select {
-		case <-fm.done:
-			l.Println("Exiting watch", watchDir)
-			return
-		default:
-			filepath.Walk(watchDir, func(path string, info os.FileInfo, err error) error {
-				if info != nil && info.Mode().IsRegular() {
-					fm.updates <- updateMsg{path, targetDir}
-				}
+// deliver brings a stable file to the pair's targets and validates it
+func (fm *FileManager) deliver(file *File, pair *WatchPair) error {
+	if err := fm.Transition(file, MovingFile); err != nil {
+		return err
+	}
 
-				return nil
-			})
-			time.Sleep(2 * time.Second)
+	// a reprocessed file may already be in place
+	if !isWithin(pair.Target, file.FilePath) {
+		if err := fm.deliverFile(file, pair); err != nil {
+			return fm.failOrRetry(file, pair, err)
 		}
 	}
+
+	if err := fm.Transition(file, MovedFile); err != nil {
+		return err
+	}
+	return fm.validate(file, pair)
+}
+
+/*
+ * Checks a moved file and marks it as valid, invalid or failed. A file is
+ * invalid if it breaks the rules of the pair, e.g. its name doesn't follow
+ * the naming convention, and failed if it was corrupted on the way.
+ */
+func (fm *FileManager) validate(file *File, pair *WatchPair) error {
+	// a resumed job may have been validating already
+	if file.Status != FileStatuses[ValidatingFile] {
+		if err := fm.Transition(file, ValidatingFile); err != nil {
+			return err
+		}
+	}
+	file.Error = ""
+
+	err := file.verifyChecksums(file.FilePath)
+	fm.logEvent(file, EventValidated, "", "", "checksums", err)
+	if err != nil {
+		fm.fail(file, pair, err)
+		return err
+	}
+
+	if !pair.SkipNaming {
+		err = file.parseName()
+		fm.logEvent(file, EventValidated, "", "", "naming", err)
+		if err != nil {
+			return fm.invalidate(file, pair, err)
+		}
+	}
+
+	if err = fm.checkMedia(file, &pair.Media); err != nil {
+		return fm.invalidate(file, pair, err)
+	}
+
+	return fm.Transition(file, ValidFile)
 }
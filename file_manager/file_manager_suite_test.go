@@ -1,6 +1,8 @@
 package file_manager_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
 	logger "github.com/Bnei-Baruch/mms-file-manager/logger"
@@ -8,8 +10,12 @@ import (
 	"github.com/joho/godotenv"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/textproto"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,6 +34,18 @@ var _ = BeforeSuite(func() {
 	// Load test ENV variables
 	godotenv.Load("../.env.test")
 
+	fm.Logger(&logger.LogParams{LogMode: "screen", LogPrefix: "[FM] "})
+	l = logger.InitLogger(&logger.LogParams{LogMode: "screen", LogPrefix: "[FM-TEST] "})
+
+	// every file manager gets its own in-memory store, no need to drop anything
+	if strings.HasPrefix(os.Getenv("DATABASE_URL"), "memory:") {
+		return
+	}
+	if strings.HasPrefix(os.Getenv("DATABASE_URL"), "bolt://") {
+		dropDB()
+		return
+	}
+
 	var err error
 	if session == nil {
 		session, err = r.Connect(r.ConnectOpts{
@@ -44,8 +62,6 @@ var _ = BeforeSuite(func() {
 	}
 
 	dropDB()
-	fm.Logger(&logger.LogParams{LogMode: "screen", LogPrefix: "[FM] "})
-	l = logger.InitLogger(&logger.LogParams{LogMode: "screen", LogPrefix: "[FM-TEST] "})
 })
 
 var _ = AfterSuite(func() {
@@ -63,7 +79,106 @@ func createTestFile(fileName string) {
 	nf.Close()
 }
 
+// createMP3File writes an MP3 file of 100 MPEG-1 layer III frames of
+// 128 kbit/s, with an ID3v2.3 title unless title is empty
+func createMP3File(fileName, title string) {
+	data := &bytes.Buffer{}
+	if title != "" {
+		size := 10 + len(title) + 1
+		data.Write([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, byte(size >> 7), byte(size & 0x7F)})
+		data.WriteString("TIT2")
+		binary.Write(data, binary.BigEndian, uint32(len(title)+1))
+		data.Write([]byte{0, 0, 0})
+		data.WriteString(title)
+	}
+	for i := 0; i < 100; i++ {
+		data.Write([]byte{0xFF, 0xFB, 0x90, 0x00})
+		data.Write(make([]byte, 413))
+	}
+	if err := ioutil.WriteFile(fileName, data.Bytes(), 0644); err != nil {
+		Fail(fmt.Sprintf("Unable to create file %s", fileName))
+	}
+}
+
+type smtpMessage struct {
+	From, To string
+	Data     string
+}
+
+/*
+ * Starts an SMTP server on a local port that accepts any mail and sends it
+ * to the returned channel. It's closed with the listener.
+ */
+func fakeSMTPServer() (net.Listener, <-chan smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		Fail(fmt.Sprintf("Unable to start SMTP server: %v", err))
+	}
+
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	return listener, messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- smtpMessage) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake SMTP")
+
+	msg := smtpMessage{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg.From = strings.Trim(line[10:], "<> ")
+			text.PrintfLine("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.To = strings.Trim(line[8:], "<> ")
+			text.PrintfLine("250 OK")
+		case command == "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			messages <- msg
+			msg = smtpMessage{}
+			text.PrintfLine("250 OK")
+		case command == "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
 func dropDB() {
+	// the file managers are destroyed by now, so nothing holds the file
+	if url := os.Getenv("DATABASE_URL"); strings.HasPrefix(url, "bolt://") {
+		if err := os.Remove(strings.TrimPrefix(url, "bolt://")); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+
+	if session == nil {
+		return
+	}
+
 	var res *r.Cursor
 
 	res, err = r.DB(dbName).TableList().ForEach(func(name r.Term) interface{} {
@@ -1,6 +1,7 @@
 package file_manager_test
 
 import (
+	"encoding/json"
 	"fmt"
 	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
 	r "github.com/dancannon/gorethink"
@@ -8,8 +9,11 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,6 +52,13 @@ aaa:
     target: 'tmp/target2'
 `,
 				`
+# unknown watcher
+watch:
+  - source: 'tmp/source1'
+    target: 'tmp/target1'
+    watcher: 'magic'
+`,
+				`
 # generaly bad yaml
   - soce: 'tmp/source1'
     target: 'tmp/target1'
@@ -135,6 +146,118 @@ watch:
 		})
 	})
 
+	Describe("Reloading configuration", func() {
+		var configFile string
+		watchDir3, targetDir3 := "tmp/source3", "tmp/target3"
+		watchFile3 := filepath.Join(watchDir3, "file3.txt")
+		targetFile3 := filepath.Join(targetDir3, "file3.txt")
+
+		writeConfig := func(data string) {
+			if err := ioutil.WriteFile(configFile, []byte(data), 0644); err != nil {
+				Fail(fmt.Sprintf("Unable to write to temp config file: %v", err))
+			}
+		}
+
+		BeforeEach(func() {
+			file, err := ioutil.TempFile("/tmp", "file_manager")
+			if err != nil {
+				Fail(fmt.Sprintf("Unable to create temp config file: %v", err))
+			}
+			file.Close()
+			configFile = file.Name()
+
+			for _, dir := range []string{watchDir1, targetDir1, watchDir3, targetDir3} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+
+			writeConfig(`
+watch:
+  - source: 'tmp/source1'
+    target: 'tmp/target1'
+`)
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore(), configFile); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+			os.Remove(configFile)
+		})
+
+		It("must start new and stop removed watches when the file changes", func() {
+			writeConfig(`
+watch:
+  - source: 'tmp/source3'
+    target: 'tmp/target3'
+`)
+
+			Eventually(func() []fm.WatchPair {
+				return fileManager.ListWatches()
+			}, 3*time.Second).Should(ConsistOf(fm.WatchPair{Source: watchDir3, Target: targetDir3}))
+
+			createTestFile(watchFile3)
+			Eventually(func() error {
+				_, err = os.Stat(targetFile3)
+				return err
+			}, 3*time.Second).ShouldNot(HaveOccurred())
+		})
+
+		It("must restart changed watches", func() {
+			writeConfig(`
+watch:
+  - source: 'tmp/source1'
+    target: 'tmp/target3'
+`)
+			Ω(fileManager.ReloadConfig()).Should(Succeed())
+
+			pairs := fileManager.ListWatches()
+			Ω(pairs).Should(HaveLen(1))
+			Ω(pairs[0].Target).Should(Equal(targetDir3))
+		})
+
+		It("must keep running watches if the new config is not valid", func() {
+			writeConfig(`
+watch:
+  - source: 'tmp/source3'
+    target: 'tmp/target3'
+    watcher: 'magic'
+`)
+			Ω(fileManager.ReloadConfig()).ShouldNot(Succeed())
+			Ω(fileManager.ListWatches()).Should(ConsistOf(fm.WatchPair{Source: watchDir1, Target: targetDir1}))
+
+			createTestFile(watchFile1)
+			Eventually(func() error {
+				_, err = os.Stat(targetFile1)
+				return err
+			}, 3*time.Second).ShouldNot(HaveOccurred())
+		})
+
+		It("must keep running watches if a new target can't be created", func() {
+			os.MkdirAll("tmp", os.ModePerm)
+			blocker := "tmp/not-a-dir"
+			createTestFile(blocker)
+			defer os.Remove(blocker)
+
+			writeConfig(`
+watch:
+  - source: 'tmp/source1'
+    target: 'tmp/not-a-dir/target'
+`)
+			Ω(fileManager.ReloadConfig()).ShouldNot(Succeed())
+			Ω(fileManager.ListWatches()).Should(ConsistOf(fm.WatchPair{Source: watchDir1, Target: targetDir1}))
+
+			createTestFile(watchFile1)
+			Eventually(func() error {
+				_, err = os.Stat(targetFile1)
+				return err
+			}, 3*time.Second).ShouldNot(HaveOccurred())
+		})
+	})
+
 	Describe("Importing files", func() {
 
 		Context("Having one file manager", func() {
@@ -211,6 +334,56 @@ watch:
 				}, 3*time.Second).ShouldNot(HaveOccurred())
 			})
 
+			It("must copy new file using the poll watcher", func() {
+				err = fileManager.AddWatch(fm.WatchPair{
+					Source:       watchDir1,
+					Target:       targetDir1,
+					Watcher:      fm.PollWatcher,
+					PollInterval: 500 * time.Millisecond,
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				createTestFile(watchFile1)
+
+				Eventually(func() error {
+					_, err := os.Stat(targetFile1)
+					return err
+				}, 3*time.Second).ShouldNot(HaveOccurred())
+			})
+
+			It("must not copy temporary files", func() {
+				fileManager.Watch(watchDir1, targetDir1)
+
+				partFile := filepath.Join(watchDir1, "file1.txt.part")
+				createTestFile(partFile)
+
+				Consistently(func() error {
+					_, err := os.Stat(partFile)
+					return err
+				}, 2*time.Second).ShouldNot(HaveOccurred())
+			})
+
+			It("must wait for the file to settle before copying", func() {
+				err = fileManager.AddWatch(fm.WatchPair{
+					Source: watchDir1,
+					Target: targetDir1,
+					Settle: fm.SettlePolicy{Duration: 2 * time.Second},
+				})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				createTestFile(watchFile1)
+
+				Consistently(func() error {
+					_, err := os.Stat(targetFile1)
+					return err
+				}, time.Second).Should(HaveOccurred())
+
+				Eventually(func() error {
+					_, err := os.Stat(targetFile1)
+					return err
+				}, 4*time.Second).ShouldNot(HaveOccurred())
+			})
+
 			It("must copy 2 new files to target dir", func() {
 
 				fileManager.Watch(watchDir1, targetDir1)
@@ -308,6 +481,70 @@ watch:
 		})
 	})
 
+	Describe("Managing watches", func() {
+		var store fm.FileStore
+
+		BeforeEach(func() {
+			store = fm.NewMemoryStore()
+			if fileManager, err = fm.NewFMWithStore(store); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must list watched pairs", func() {
+			fileManager.Watch(watchDir2, targetDir2)
+			fileManager.Watch(watchDir1, targetDir1)
+
+			pairs := fileManager.ListWatches()
+			Ω(pairs).Should(HaveLen(2))
+			Ω(pairs[0].Source).Should(Equal(watchDir1))
+			Ω(pairs[1].Source).Should(Equal(watchDir2))
+		})
+
+		It("must stop watching after unwatch", func() {
+			fileManager.Watch(watchDir1, targetDir1)
+			Ω(fileManager.Unwatch(watchDir1)).Should(Succeed())
+			Ω(fileManager.ListWatches()).Should(BeEmpty())
+
+			createTestFile(watchFile1)
+
+			Consistently(func() error {
+				_, err := os.Stat(watchFile1)
+				return err
+			}, 2*time.Second).ShouldNot(HaveOccurred())
+
+			err = fileManager.Unwatch(watchDir1)
+			Ω(err).Should(BeAssignableToTypeOf(&fm.WatchError{}))
+		})
+
+		It("must watch stored pairs again after restart", func() {
+			Ω(fileManager.AddStoredWatch(fm.WatchPair{Source: watchDir1, Target: targetDir1})).Should(Succeed())
+			fileManager.Destroy()
+
+			if fileManager, err = fm.NewFMWithStore(store); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			pairs := fileManager.ListWatches()
+			Ω(pairs).Should(HaveLen(1))
+			Ω(pairs[0].Target).Should(Equal(targetDir1))
+
+			Ω(fileManager.Unwatch(watchDir1)).Should(Succeed())
+			stored, err := store.ListWatches()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(stored).Should(BeEmpty())
+		})
+	})
+
 	Describe("Database Integrity", func() {
 		BeforeEach(func() {
 			dropDB()
@@ -329,6 +566,9 @@ watch:
 		})
 
 		It("must create only one record per path in db", func() {
+			if session == nil {
+				Skip("requires RethinkDB")
+			}
 			fileManager.Watch(watchDir1, targetDir1)
 			fileManager.Watch(watchDir2, targetDir2)
 			createTestFile(watchFile1)
@@ -345,26 +585,1592 @@ watch:
 			createTestFile(watchFile1)
 
 			//check that file is in db
-			file, err := fileManager.FindOneFile(filepath.Base(watchFile1))
-			Ω(err).ShouldNot(HaveOccurred())
-			Ω(file).ShouldNot(BeNil())
+			Eventually(func() *fm.File {
+				file, err := fileManager.FindOneFile(filepath.Base(watchFile1))
+				Ω(err).ShouldNot(HaveOccurred())
+				return file
+			}, 3*time.Second).ShouldNot(BeNil())
 		})
 	})
 
-	XDescribe("Validating files", func() {
-		XIt("must validate id3", func() {
+	Describe("Checksums", func() {
+		BeforeEach(func() {
+			dropDB()
+			if fileManager, err = fm.NewFM(dbName); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			if err = os.RemoveAll(watchDir1); err != nil {
+				Fail("Unable to remove watch dir")
+			}
+
+			if err = os.RemoveAll(targetDir1); err != nil {
+				Fail("Unable to remove target dir")
+			}
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
 		})
 
-		XContext("When file is valid", func() {
-			XIt("mark file as valid", func() {
+		It("must record size and configured checksums", func() {
+			err = fileManager.AddWatch(fm.WatchPair{
+				Source:     watchDir1,
+				Target:     targetDir1,
+				SkipNaming: true,
+				Checksums:  []string{fm.MD5, fm.SHA256},
 			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			createTestFile(watchFile1)
+
+			var file *fm.File
+			Eventually(func() string {
+				if file, _ = fileManager.FindOneFile(filepath.Base(watchFile1)); file == nil {
+					return ""
+				}
+				return file.Status
+			}, 3*time.Second).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+
+			Ω(file.Size).Should(BeZero())
+			Ω(file.Md5).Should(Equal("d41d8cd98f00b204e9800998ecf8427e"))
+			Ω(file.Sha256).Should(Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+			Ω(file.Sha1).Should(BeEmpty())
+		})
+
+		It("must keep the history of the file", func() {
+			fileManager.AddWatch(fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true})
+
+			createTestFile(watchFile1)
+
+			var file *fm.File
+			Eventually(func() string {
+				if file, _ = fileManager.FindOneFile(filepath.Base(watchFile1)); file == nil {
+					return ""
+				}
+				return file.Status
+			}, 3*time.Second).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+
+			events, err := fileManager.FileHistory(file.Id)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			actions := []string{}
+			for _, event := range events {
+				actions = append(actions, event.Action)
+				if event.Action == fm.EventMoved {
+					Ω(event.From).Should(Equal(watchFile1))
+					Ω(event.To).Should(Equal(targetFile1))
+				}
+			}
+			Ω(actions).Should(ContainElement(fm.EventDetected))
+			Ω(actions).Should(ContainElement(fm.EventChecksum))
+			Ω(actions).Should(ContainElement(fm.EventMoved))
+			Ω(actions).Should(ContainElement(fm.EventValidated))
+		})
+	})
+
+	Describe("Status lifecycle", func() {
+		BeforeEach(func() {
+			dropDB()
+			if fileManager, err = fm.NewFM(dbName); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			if err = os.RemoveAll(watchDir1); err != nil {
+				Fail("Unable to remove watch dir")
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must allow legal transitions and update the timestamp", func() {
+			createTestFile(watchFile1)
+			file, err := fileManager.CreateFileRecord(watchFile1)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.DetectedFile]))
+
+			updatedAt := file.UpdatedAt
+			Ω(fileManager.Transition(file, fm.StableFile)).Should(Succeed())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.StableFile]))
+			Ω(file.UpdatedAt).Should(BeTemporally(">", updatedAt))
+
+			Ω(fileManager.Transition(file, fm.FailedFile)).Should(Succeed())
+		})
+
+		It("must reject illegal transitions", func() {
+			createTestFile(watchFile1)
+			file, err := fileManager.CreateFileRecord(watchFile1)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = fileManager.Transition(file, fm.PublishedFile)
+			Ω(err).Should(BeAssignableToTypeOf(&fm.TransitionError{}))
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.DetectedFile]))
+
+			stored, _ := fileManager.FindOneFile(filepath.Base(watchFile1))
+			Ω(stored.Status).Should(Equal(fm.FileStatuses[fm.DetectedFile]))
 		})
 
-		XContext("When file is invalid", func() {
-			XIt("mark file as invalid", func() {
+		It("must take NEW records of older versions as detected", func() {
+			store := fm.NewMemoryStore()
+			file := &fm.File{FileName: "old.txt", Status: "NEW"}
+			Ω(store.CreateFile(file)).Should(Succeed())
+			old, err := fm.NewFMWithStore(store)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer old.Destroy()
+
+			files, _ := old.ListFiles(&fm.FileFilter{Status: fm.FileStatuses[fm.NewFile]})
+			Ω(files).Should(HaveLen(1))
+			Ω(old.Transition(file, fm.StableFile)).Should(Succeed())
+		})
+	})
+
+	Describe("One-off imports", func() {
+		pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true}
+
+		BeforeEach(func() {
+			if fileManager, err = fm.OpenFM(dbName); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must import a file without watching", func() {
+			createTestFile(watchFile1)
+			file, err := fileManager.Import(watchFile1, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile1))
+			Ω(fileManager.ListWatches()).Should(BeEmpty())
+		})
+
+		It("must reprocess a failed file", func() {
+			// a directory in the way of the target makes the move fail
+			pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, Layout: fm.LayoutMirror, SkipNaming: true}
+			os.MkdirAll(targetFile1, os.ModePerm)
+			createTestFile(watchFile1)
+			file, err := fileManager.Import(watchFile1, pair)
+			Ω(err).Should(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+
+			os.Remove(targetFile1)
+			file, err = fileManager.Reprocess(file.Id, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.Error).Should(BeEmpty())
+
+			_, err = fileManager.Reprocess(file.Id, pair)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		Context("Target layout", func() {
+			subFile1 := filepath.Join(watchDir1, "a", "file1.txt")
+			subFile2 := filepath.Join(watchDir1, "b", "file1.txt")
+
+			BeforeEach(func() {
+				os.MkdirAll(filepath.Dir(subFile1), os.ModePerm)
+				os.MkdirAll(filepath.Dir(subFile2), os.ModePerm)
+				createTestFile(subFile1)
+				createTestFile(subFile2)
+			})
+
+			It("must add a suffix to taken names when flattening", func() {
+				file1, err := fileManager.Import(subFile1, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				file2, err := fileManager.Import(subFile2, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(file1.FilePath).Should(Equal(targetFile1))
+				Ω(file2.FilePath).Should(Equal(filepath.Join(targetDir1, "file1_1.txt")))
+			})
+
+			It("must keep subdirectories when mirroring", func() {
+				pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, Layout: fm.LayoutMirror}
+				file1, err := fileManager.Import(subFile1, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				file2, err := fileManager.Import(subFile2, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(file1.FilePath).Should(Equal(filepath.Join(targetDir1, "a", "file1.txt")))
+				Ω(file2.FilePath).Should(Equal(filepath.Join(targetDir1, "b", "file1.txt")))
+			})
+
+			It("must place files by the target template", func() {
+				pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, TargetTemplate: "{{.Year}}/{{.Month}}/{{.Lang}}/{{.Dir}}/{{.Name}}"}
+				lesson := filepath.Join(watchDir1, "a", "heb_o_rav_2015-10-06_lesson.mp4")
+				notes := filepath.Join(watchDir1, "notes.txt")
+				createTestFile(lesson)
+				createTestFile(notes)
+				mtime := time.Date(2016, 1, 2, 12, 0, 0, 0, time.Local)
+				os.Chtimes(notes, mtime, mtime)
+
+				file, err := fileManager.Import(lesson, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.FilePath).Should(Equal(filepath.Join(targetDir1, "2015", "10", "heb", "a", "heb_o_rav_2015-10-06_lesson.mp4")))
+
+				// without a date in the name the modification time is used
+				file, err = fileManager.Import(notes, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.FilePath).Should(Equal(filepath.Join(targetDir1, "2016", "01", "notes.txt")))
+			})
+
+			It("must place files by their media", func() {
+				pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true, TargetTemplate: "{{.Media.Format}}/{{.Name}}"}
+				lesson := filepath.Join(watchDir1, "lesson.mp3")
+				createMP3File(lesson, "Lesson")
+
+				file, err := fileManager.Import(lesson, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.FilePath).Should(Equal(filepath.Join(targetDir1, "mp3", "lesson.mp3")))
 			})
-			XIt("send notification to admin", func() {
+
+			It("must reject bad target templates", func() {
+				for _, text := range []string{"{{.Year", "{{.Nope}}/{{.Name}}"} {
+					_, err := fileManager.Import(subFile1, fm.WatchPair{Source: watchDir1, Target: targetDir1, TargetTemplate: text})
+					Ω(err).Should(HaveOccurred())
+				}
+
+				file, err := fileManager.Import(subFile1, fm.WatchPair{Source: watchDir1, Target: targetDir1, TargetTemplate: "../{{.Name}}"})
+				Ω(err).Should(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
 			})
 		})
 	})
+
+	Describe("Duplicates", func() {
+		duplicatesDir := "tmp/duplicates"
+		copyFile := filepath.Join(watchDir1, "file1-copy.txt")
+
+		BeforeEach(func() {
+			dropDB()
+			if fileManager, err = fm.NewFM(dbName); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1, duplicatesDir} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		importOriginal := func(policy fm.DuplicatePolicy) {
+			err = fileManager.AddWatch(fm.WatchPair{
+				Source:     watchDir1,
+				Target:     targetDir1,
+				SkipNaming: true,
+				Duplicates: policy,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			createTestFile(watchFile1)
+			Eventually(func() *fm.File {
+				file, _ := fileManager.FindOneFile(filepath.Base(watchFile1))
+				return file
+			}, 3*time.Second).ShouldNot(BeNil())
+		}
+
+		It("must import same content as a new version", func() {
+			importOriginal(fm.DuplicatePolicy{})
+			original, _ := fileManager.FindOneFile(filepath.Base(watchFile1))
+
+			createTestFile(copyFile)
+
+			var file *fm.File
+			Eventually(func() *fm.File {
+				file, _ = fileManager.FindOneFile(filepath.Base(copyFile))
+				return file
+			}, 3*time.Second).ShouldNot(BeNil())
+			Ω(file.OriginalId).Should(Equal(original.Id))
+			Ω(file.Version).Should(Equal(2))
+		})
+
+		It("must delete the incoming copy when skipping", func() {
+			importOriginal(fm.DuplicatePolicy{Policy: fm.DuplicateSkip})
+
+			createTestFile(copyFile)
+
+			Eventually(func() bool {
+				_, err := os.Stat(copyFile)
+				return os.IsNotExist(err)
+			}, 3*time.Second).Should(BeTrue())
+			_, err = os.Stat(filepath.Join(targetDir1, filepath.Base(copyFile)))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			// the original is still there
+			original, _ := fileManager.FindOneFile(filepath.Base(watchFile1))
+			events, _ := fileManager.FileHistory(original.Id)
+			for _, event := range events {
+				Ω(event.Action).ShouldNot(Equal(fm.EventDeleted))
+			}
+		})
+
+		It("must not skip copies of an invalid file", func() {
+			os.MkdirAll(watchDir1, os.ModePerm)
+			pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, Duplicates: fm.DuplicatePolicy{Policy: fm.DuplicateSkip}}
+
+			createTestFile(watchFile1)
+			original, err := fileManager.Import(watchFile1, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(original.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+
+			createTestFile(copyFile)
+			file, err := fileManager.Import(copyFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.OriginalId).Should(Equal(original.Id))
+			Ω(file.FilePath).Should(Equal(filepath.Join(targetDir1, filepath.Base(copyFile))))
+		})
+
+		It("must keep the history of skipped copies", func() {
+			os.MkdirAll(watchDir1, os.ModePerm)
+			boltFile := "tmp/duplicates.db"
+			os.Remove(boltFile)
+			store, err := fm.NewBoltStore(boltFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			manager, err := fm.NewFMWithStore(store)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer manager.Destroy()
+
+			pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true, Duplicates: fm.DuplicatePolicy{Policy: fm.DuplicateSkip}}
+			createTestFile(watchFile1)
+			original, err := manager.Import(watchFile1, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			createTestFile(copyFile)
+			file, err := manager.Import(copyFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Id).ShouldNot(BeEmpty())
+
+			events, err := manager.FileHistory(file.Id)
+			Ω(err).ShouldNot(HaveOccurred())
+			skipped := []fm.FileEvent{}
+			for _, event := range events {
+				if event.Action == fm.EventSkipped {
+					skipped = append(skipped, *event)
+				}
+			}
+			Ω(skipped).Should(HaveLen(1))
+			Ω(skipped[0].From).Should(Equal(copyFile))
+			Ω(skipped[0].Details).Should(Equal("duplicate of " + original.Id))
+		})
+
+		It("must move the incoming copy to the duplicates dir", func() {
+			importOriginal(fm.DuplicatePolicy{Policy: fm.DuplicateQuarantine, Dir: duplicatesDir})
+
+			createTestFile(copyFile)
+
+			Eventually(func() error {
+				_, err := os.Stat(filepath.Join(duplicatesDir, filepath.Base(copyFile)))
+				return err
+			}, 3*time.Second).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Naming convention", func() {
+		pair := fm.WatchPair{Source: watchDir1, Target: targetDir1}
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		importName := func(name string) *fm.File {
+			path := filepath.Join(watchDir1, name)
+			createTestFile(path)
+			file, err := fileManager.Import(path, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			return file
+		}
+
+		It("must parse names into fields", func() {
+			file := importName("heb_o_rav_2015-10-06_lesson_bs-shamati-001_n1_p1.mp4")
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.Language).Should(Equal("heb"))
+			Ω(file.Original).Should(BeTrue())
+			Ω(file.Lecturer).Should(Equal("rav"))
+			Ω(file.Date).Should(Equal(time.Date(2015, 10, 6, 0, 0, 0, 0, time.UTC)))
+			Ω(file.ContentType).Should(Equal("lesson"))
+			Ω(file.Description).Should(Equal("bs-shamati-001"))
+			Ω(file.Number).Should(Equal(1))
+			Ω(file.Part).Should(Equal(1))
+
+			stored, err := fileManager.FindFileById(file.Id)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(stored.Lecturer).Should(Equal("rav"))
+		})
+
+		It("must parse names without optional parts", func() {
+			file := importName("rus_t_rav_2015-10-06_lesson.mp3")
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.Original).Should(BeFalse())
+			Ω(file.Description).Should(BeEmpty())
+			Ω(file.Part).Should(BeZero())
+		})
+
+		It("must mark files with other names as invalid", func() {
+			for _, name := range []string{
+				"file1.txt",
+				"heb_x_rav_2015-10-06_lesson.mp4",
+				"heb_o_rav_2015-13-06_lesson.mp4",
+				"hebrew_o_rav_2015-10-06_lesson.mp4",
+			} {
+				file := importName(name)
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]), name)
+				Ω(file.Error).Should(ContainSubstring("naming convention"))
+			}
+		})
+	})
+
+	Describe("Quarantine", func() {
+		quarantineDir := "tmp/quarantine1"
+		pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, Quarantine: quarantineDir}
+		quarantined := filepath.Join(quarantineDir, "file1.txt")
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1, quarantineDir} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+			createTestFile(watchFile1)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must quarantine invalid files with a sidecar", func() {
+			file, err := fileManager.Import(watchFile1, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+			Ω(file.FilePath).Should(Equal(quarantined))
+
+			data, err := ioutil.ReadFile(quarantined + ".error.json")
+			Ω(err).ShouldNot(HaveOccurred())
+			report := fm.QuarantineReport{}
+			Ω(json.Unmarshal(data, &report)).Should(Succeed())
+			Ω(report.FileId).Should(Equal(file.Id))
+			Ω(report.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+			Ω(report.Path).Should(Equal(filepath.Join(targetDir1, "file1.txt")))
+			Ω(report.Error).Should(ContainSubstring("naming convention"))
+		})
+
+		It("must quarantine files that fail to move", func() {
+			pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, Quarantine: quarantineDir, Layout: fm.LayoutMirror}
+			os.MkdirAll(targetFile1, os.ModePerm)
+
+			file, err := fileManager.Import(watchFile1, pair)
+			Ω(err).Should(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+			Ω(file.FilePath).Should(Equal(quarantined))
+			_, err = os.Stat(watchFile1)
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("must release quarantined files", func() {
+			file, _ := fileManager.Import(watchFile1, pair)
+
+			_, err = fileManager.Release(file.Id, fm.WatchPair{Source: watchDir1, Target: targetDir1})
+			Ω(err).Should(BeAssignableToTypeOf(&fm.QuarantineError{}))
+
+			pair := pair
+			pair.SkipNaming = true
+			file, err = fileManager.Release(file.Id, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile1))
+
+			_, err = os.Stat(quarantined + ".error.json")
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+	})
+
+	Describe("Validating files", func() {
+		mp3File := filepath.Join(watchDir1, "lesson.mp3")
+		rules := fm.MediaRules{Validate: true, RequiredTags: []string{"title"}, MinBitrate: 64, MaxBitrate: 320}
+		pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true, Media: rules}
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must validate id3", func() {
+			createMP3File(mp3File, "Lesson")
+
+			file, err := fileManager.Import(mp3File, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Media).ShouldNot(BeNil())
+			Ω(file.Media.Format).Should(Equal("mp3"))
+			Ω(file.Media.Bitrate).Should(Equal(128))
+			Ω(file.Media.Duration).Should(BeNumerically(">", 0))
+			Ω(file.Media.Tags).Should(HaveKeyWithValue("title", "Lesson"))
+
+			stored, err := fileManager.FindFileById(file.Id)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(stored.Media).Should(Equal(file.Media))
+		})
+
+		Context("When file is valid", func() {
+			It("mark file as valid", func() {
+				createMP3File(mp3File, "Lesson")
+
+				file, err := fileManager.Import(mp3File, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+				Ω(file.FilePath).Should(Equal(filepath.Join(targetDir1, "lesson.mp3")))
+			})
+
+			It("must not check other formats", func() {
+				createTestFile(watchFile1)
+
+				file, err := fileManager.Import(watchFile1, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+				Ω(file.Media).Should(BeNil())
+			})
+		})
+
+		Context("When file is invalid", func() {
+			It("mark file as invalid", func() {
+				createMP3File(mp3File, "")
+
+				file, err := fileManager.Import(mp3File, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+				Ω(file.Error).Should(ContainSubstring(`tag "title" is missing`))
+				Ω(file.Media).ShouldNot(BeNil())
+			})
+
+			It("must mark files out of the bitrate range as invalid", func() {
+				createMP3File(mp3File, "Lesson")
+
+				pair := pair
+				pair.Media.MaxBitrate = 96
+				file, _ := fileManager.Import(mp3File, pair)
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+				Ω(file.Error).Should(ContainSubstring("above 96"))
+			})
+
+			It("must mark unreadable files as invalid", func() {
+				createTestFile(mp3File)
+
+				file, _ := fileManager.Import(mp3File, pair)
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+				Ω(file.Media).Should(BeNil())
+
+				pair := pair
+				pair.Media.Validate = false
+				file, err = fileManager.Reprocess(file.Id, pair)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			})
+
+			It("send notification to admin", func() {
+				listener, messages := fakeSMTPServer()
+				defer listener.Close()
+
+				Ω(fileManager.SetNotify(fm.NotifyConfig{
+					SMTP:  listener.Addr().String(),
+					From:  "MMS <mms@example.com>",
+					To:    []string{"admin@example.com"},
+					Batch: 200 * time.Millisecond,
+				})).Should(Succeed())
+
+				pair := pair
+				pair.Notify = []string{"studio@example.com"}
+				files := []string{mp3File, filepath.Join(watchDir1, "lesson2.mp3")}
+				for i, path := range files {
+					createMP3File(path, "")
+					// different content, so that the second isn't a version of the first
+					f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+					f.Write(make([]byte, i))
+					f.Close()
+
+					file, _ := fileManager.Import(path, pair)
+					Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+				}
+
+				// one mail per recipient with both files
+				received := map[string]smtpMessage{}
+				for i := 0; i < 2; i++ {
+					var msg smtpMessage
+					Eventually(messages, 2*time.Second).Should(Receive(&msg))
+					received[msg.To] = msg
+				}
+				Consistently(messages, 300*time.Millisecond).ShouldNot(Receive())
+
+				Ω(received).Should(HaveKey("admin@example.com"))
+				Ω(received).Should(HaveKey("studio@example.com"))
+				for _, msg := range received {
+					Ω(msg.From).Should(Equal("mms@example.com"))
+					Ω(msg.Data).Should(ContainSubstring("Subject: [MMS] 2 files need attention"))
+					Ω(msg.Data).Should(ContainSubstring("lesson.mp3 is INVALID"))
+					Ω(msg.Data).Should(ContainSubstring("lesson2.mp3 is INVALID"))
+					Ω(msg.Data).Should(ContainSubstring(`tag "title" is missing`))
+					Ω(msg.Data).Should(ContainSubstring(watchDir1 + " -> " + targetDir1))
+				}
+			})
+
+			It("must encode the subject", func() {
+				listener, messages := fakeSMTPServer()
+				defer listener.Close()
+
+				Ω(fileManager.SetNotify(fm.NotifyConfig{
+					SMTP:  listener.Addr().String(),
+					From:  "mms@example.com",
+					To:    []string{"admin@example.com"},
+					Batch: 100 * time.Millisecond,
+				})).Should(Succeed())
+
+				path := filepath.Join(watchDir1, "שיעור.mp3")
+				createMP3File(path, "")
+				file, _ := fileManager.Import(path, pair)
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.InvalidFile]))
+
+				var msg smtpMessage
+				Eventually(messages, 2*time.Second).Should(Receive(&msg))
+				Ω(msg.Data).Should(ContainSubstring("Subject: =?utf-8?q?[MMS]_"))
+				Ω(msg.Data).ShouldNot(ContainSubstring("Subject: [MMS] שיעור"))
+			})
+
+			It("must reject bad notification settings", func() {
+				Ω(fileManager.SetNotify(fm.NotifyConfig{SMTP: "localhost"})).ShouldNot(Succeed())
+				Ω(fileManager.SetNotify(fm.NotifyConfig{SMTP: "localhost:25", From: "mms@example.com", To: []string{"admin"}})).ShouldNot(Succeed())
+
+				pair := pair
+				pair.Notify = []string{"not an address"}
+				Ω(fileManager.AddWatch(pair)).ShouldNot(Succeed())
+			})
+		})
+	})
+	Describe("Webhooks", func() {
+		type hookRequest struct {
+			Event, Signature string
+			Body             []byte
+			Payload          fm.HookPayload
+		}
+
+		var (
+			server   *httptest.Server
+			requests chan hookRequest
+			failures int32
+		)
+		pair := fm.WatchPair{Source: watchDir1, Target: targetDir1, SkipNaming: true}
+
+		BeforeEach(func() {
+			requests = make(chan hookRequest, 10)
+			atomic.StoreInt32(&failures, 0)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if atomic.AddInt32(&failures, -1) >= 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				hook := hookRequest{Event: req.Header.Get("X-MMS-Event"), Signature: req.Header.Get(fm.SignatureHeader)}
+				hook.Body, _ = ioutil.ReadAll(req.Body)
+				json.Unmarshal(hook.Body, &hook.Payload)
+				requests <- hook
+			}))
+
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{watchDir1, targetDir1} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(watchDir1, os.ModePerm)
+			createTestFile(watchFile1)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+			server.Close()
+		})
+
+		It("must post signed events of imported files", func() {
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Secret: "secret"}})).Should(Succeed())
+
+			file, err := fileManager.Import(watchFile1, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var hook hookRequest
+			for _, event := range []string{fm.HookImported, fm.HookValidated} {
+				Eventually(requests, 2*time.Second).Should(Receive(&hook))
+				Ω(hook.Event).Should(Equal(event))
+				Ω(hook.Signature).Should(Equal(fm.Sign("secret", hook.Body)))
+				Ω(hook.Payload.Event).Should(Equal(event))
+				Ω(hook.Payload.File.Id).Should(Equal(file.Id))
+			}
+			Ω(hook.Payload.File.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+
+			Eventually(func() []string {
+				deliveries, _ := fileManager.FileDeliveries(file.Id)
+				statuses := []string{}
+				for _, d := range deliveries {
+					statuses = append(statuses, d.Status)
+				}
+				return statuses
+			}).Should(Equal([]string{fm.DeliveryDelivered, fm.DeliveryDelivered}))
+		})
+
+		It("must send only the selected events", func() {
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Secret: "secret", Events: []string{fm.HookValidated}}})).Should(Succeed())
+
+			fileManager.Import(watchFile1, pair)
+
+			var hook hookRequest
+			Eventually(requests, 2*time.Second).Should(Receive(&hook))
+			Ω(hook.Event).Should(Equal(fm.HookValidated))
+			Consistently(requests, 200*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("must take the webhooks of a config file", func() {
+			configFile := "tmp/webhooks.yml"
+			config := fmt.Sprintf("watch: []\nwebhooks:\n  - url: '%s'\n    events: [%s]\n", server.URL, fm.HookValidated)
+			Ω(ioutil.WriteFile(configFile, []byte(config), 0644)).Should(Succeed())
+			Ω(fileManager.ApplyConfig(configFile)).Should(Succeed())
+
+			fileManager.Import(watchFile1, pair)
+
+			var hook hookRequest
+			Eventually(requests, 2*time.Second).Should(Receive(&hook))
+			Ω(hook.Event).Should(Equal(fm.HookValidated))
+			Ω(fileManager.ApplyConfig("tmp/missing.yml")).ShouldNot(Succeed())
+		})
+
+		It("must post deleted events of skipped duplicates", func() {
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Events: []string{fm.HookDeleted}}})).Should(Succeed())
+
+			skip := pair
+			skip.Duplicates = fm.DuplicatePolicy{Policy: fm.DuplicateSkip}
+			_, err := fileManager.Import(watchFile1, skip)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			copyFile := filepath.Join(watchDir1, "file1-copy.txt")
+			createTestFile(copyFile)
+			file, err := fileManager.Import(copyFile, skip)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var hook hookRequest
+			Eventually(requests, 2*time.Second).Should(Receive(&hook))
+			Ω(hook.Event).Should(Equal(fm.HookDeleted))
+			Ω(hook.Payload.File.Id).Should(Equal(file.Id))
+			Consistently(requests, 200*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("must retry failed deliveries with backoff", func() {
+			atomic.StoreInt32(&failures, 2)
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Secret: "secret", Events: []string{fm.HookValidated}, Backoff: 50 * time.Millisecond}})).Should(Succeed())
+
+			file, _ := fileManager.Import(watchFile1, pair)
+			Eventually(requests, 2*time.Second).Should(Receive())
+
+			deliveries, _ := fileManager.FileDeliveries(file.Id)
+			Ω(deliveries).Should(HaveLen(1))
+			Eventually(func() int {
+				deliveries, _ := fileManager.FileDeliveries(file.Id)
+				return deliveries[0].Attempts
+			}).Should(Equal(3))
+		})
+
+		It("must give up after the last attempt", func() {
+			atomic.StoreInt32(&failures, 100)
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Events: []string{fm.HookValidated}, MaxAttempts: 2, Backoff: 10 * time.Millisecond}})).Should(Succeed())
+
+			file, _ := fileManager.Import(watchFile1, pair)
+			Eventually(func() string {
+				deliveries, _ := fileManager.FileDeliveries(file.Id)
+				if len(deliveries) == 0 {
+					return ""
+				}
+				return deliveries[0].Status
+			}, 2*time.Second).Should(Equal(fm.DeliveryFailed))
+
+			deliveries, _ := fileManager.FileDeliveries(file.Id)
+			Ω(deliveries[0].Attempts).Should(Equal(2))
+			Ω(deliveries[0].StatusCode).Should(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("must send deliveries left over by a previous run", func() {
+			store := fm.NewMemoryStore()
+			delivery := &fm.WebhookDelivery{
+				FileId:    "leftover",
+				Event:     fm.HookImported,
+				URL:       server.URL,
+				Payload:   `{"event":"imported"}`,
+				Status:    fm.DeliveryPending,
+				CreatedAt: time.Now(),
+			}
+			Ω(store.SaveDelivery(delivery)).Should(Succeed())
+
+			restarted, err := fm.NewFMWithStore(store)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer restarted.Destroy()
+			Ω(restarted.SetWebhooks([]fm.Webhook{{URL: server.URL, Secret: "secret"}})).Should(Succeed())
+
+			var hook hookRequest
+			Eventually(requests, 2*time.Second).Should(Receive(&hook))
+			Ω(hook.Payload.Event).Should(Equal(fm.HookImported))
+		})
+
+		Context("with file managers sharing the store", func() {
+			var (
+				store fm.FileStore
+				other *fm.FileManager
+			)
+
+			// pending saves a delivery of event to url left for the file managers
+			pending := func(url, event string) *fm.WebhookDelivery {
+				delivery := &fm.WebhookDelivery{
+					FileId:      "shared",
+					Event:       event,
+					URL:         url,
+					Payload:     fmt.Sprintf(`{"event":%q}`, event),
+					Status:      fm.DeliveryPending,
+					NextAttempt: time.Now(),
+					CreatedAt:   time.Now(),
+				}
+				Ω(store.SaveDelivery(delivery)).Should(Succeed())
+				return delivery
+			}
+
+			BeforeEach(func() {
+				store = fm.NewMemoryStore()
+				if other, err = fm.NewFMWithStore(store); err != nil {
+					Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+				}
+			})
+
+			AfterEach(func() {
+				other.Destroy()
+			})
+
+			It("must post every delivery once", func() {
+				for _, event := range []string{fm.HookImported, fm.HookValidated, fm.HookFailed} {
+					pending(server.URL, event)
+				}
+				shared, err := fm.NewFMWithStore(store)
+				Ω(err).ShouldNot(HaveOccurred())
+				defer shared.Destroy()
+				for _, m := range []*fm.FileManager{other, shared} {
+					Ω(m.SetWebhooks([]fm.Webhook{{URL: server.URL}})).Should(Succeed())
+				}
+
+				for i := 0; i < 3; i++ {
+					Eventually(requests, 2*time.Second).Should(Receive())
+				}
+				Consistently(requests, 1500*time.Millisecond).ShouldNot(Receive())
+			})
+
+			It("must leave deliveries to webhooks configured elsewhere", func() {
+				delivery := pending(server.URL, fm.HookImported)
+				Ω(other.SetWebhooks([]fm.Webhook{{URL: server.URL + "/other"}})).Should(Succeed())
+
+				Consistently(func() string {
+					deliveries, _ := store.FileDeliveries(delivery.FileId)
+					return deliveries[0].Status
+				}, 1500*time.Millisecond).Should(Equal(fm.DeliveryPending))
+			})
+
+			It("must not wait for a webhook that is down", func() {
+				hung := make(chan bool)
+				down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					<-hung
+				}))
+				defer down.Close()
+				defer close(hung)
+
+				pending(down.URL, fm.HookImported)
+				pending(server.URL, fm.HookValidated)
+				Ω(other.SetWebhooks([]fm.Webhook{{URL: down.URL}, {URL: server.URL}})).Should(Succeed())
+
+				var hook hookRequest
+				Eventually(requests, 2*time.Second).Should(Receive(&hook))
+				Ω(hook.Event).Should(Equal(fm.HookValidated))
+			})
+		})
+
+		It("must reject bad webhooks", func() {
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: "ftp://example.com"}})).ShouldNot(Succeed())
+			Ω(fileManager.SetWebhooks([]fm.Webhook{{URL: server.URL, Events: []string{"published"}}})).ShouldNot(Succeed())
+		})
+	})
+	Describe("Worker pool", func() {
+		source, target := "tmp/source4", "tmp/target4"
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{source, target} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(source, os.ModePerm)
+			for i := 0; i < 40; i++ {
+				createTestFile(filepath.Join(source, fmt.Sprintf("file%02d.txt", i)))
+			}
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		// watch imports the files of source and returns the largest
+		// queue stats seen meanwhile
+		watch := func(pair fm.WatchPair) (max fm.QueueStats) {
+			stop := make(chan bool)
+			sampled := make(chan fm.QueueStats)
+			go func() {
+				max := fm.QueueStats{Pairs: map[string]*fm.PairStats{source: {}}}
+				for {
+					select {
+					case <-stop:
+						sampled <- max
+						return
+					default:
+					}
+
+					stats := fileManager.QueueStats()
+					if stats.Queued > max.Queued {
+						max.Queued = stats.Queued
+					}
+					if stats.Running > max.Running {
+						max.Running = stats.Running
+					}
+					if p, ok := stats.Pairs[source]; ok && p.Running > max.Pairs[source].Running {
+						max.Pairs[source].Running = p.Running
+					}
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+
+			Ω(fileManager.AddWatch(pair)).Should(Succeed())
+			Eventually(func() int {
+				files, _ := ioutil.ReadDir(target)
+				return len(files)
+			}, 10*time.Second).Should(Equal(40))
+			Eventually(func() int { return fileManager.QueueStats().Running }).Should(BeZero())
+
+			close(stop)
+			return <-sampled
+		}
+
+		It("must not run more imports than workers", func() {
+			Ω(fileManager.SetPool(fm.PoolConfig{Workers: 2})).Should(Succeed())
+
+			max := watch(fm.WatchPair{Source: source, Target: target})
+			Ω(max.Running).Should(BeNumerically("<=", 2))
+			Ω(max.Running).Should(BeNumerically(">", 0))
+		})
+
+		It("must limit the imports of a pair", func() {
+			max := watch(fm.WatchPair{Source: source, Target: target, Workers: 1})
+			Ω(max.Pairs[source].Running).Should(Equal(1))
+		})
+
+		It("must hold the watchers back while the queue is full", func() {
+			Ω(fileManager.SetPool(fm.PoolConfig{Workers: 1, QueueSize: 5})).Should(Succeed())
+
+			max := watch(fm.WatchPair{Source: source, Target: target})
+			Ω(max.Queued).Should(BeNumerically("<=", 5))
+
+			stats := fileManager.QueueStats()
+			Ω(stats.Queued).Should(BeZero())
+			Ω(stats.Workers).Should(Equal(1))
+			Ω(stats.QueueSize).Should(Equal(5))
+		})
+
+		It("must finish running imports before closing the store", func() {
+			boltFile := "tmp/pool.db"
+			os.Remove(boltFile)
+			store, err := fm.NewBoltStore(boltFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			manager, err := fm.NewFMWithStore(store)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(manager.AddWatch(fm.WatchPair{Source: source, Target: target, SkipNaming: true})).Should(Succeed())
+			Eventually(func() int { return manager.QueueStats().Running }, time.Second, time.Millisecond).ShouldNot(BeZero())
+			manager.Destroy()
+
+			store, err = fm.NewBoltStore(boltFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer store.Close()
+			files, err := store.ListFiles(&fm.FileFilter{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files).ShouldNot(BeEmpty())
+			for _, file := range files {
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			}
+		})
+
+		It("must reject bad limits", func() {
+			Ω(fileManager.SetPool(fm.PoolConfig{Workers: -1})).ShouldNot(Succeed())
+			Ω(fileManager.AddWatch(fm.WatchPair{Source: source, Target: target, Workers: -1})).ShouldNot(Succeed())
+		})
+	})
+	Describe("Persistent jobs", func() {
+		source, target := "tmp/source5", "tmp/target5"
+		sourceFile, targetFile := filepath.Join(source, "file.txt"), filepath.Join(target, "file.txt")
+		pair := fm.WatchPair{Source: source, Target: target, SkipNaming: true}
+		var store fm.FileStore
+
+		BeforeEach(func() {
+			store = fm.NewMemoryStore()
+			for _, dir := range []string{source, target} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+				os.MkdirAll(dir, os.ModePerm)
+			}
+		})
+
+		AfterEach(func() {
+			if fileManager != nil {
+				fileManager.Destroy()
+				fileManager = nil
+			}
+		})
+
+		// restart starts a file manager on the store with job,
+		// as if the previous one died while it was queued or running
+		restart := func(job *fm.Job) {
+			Ω(store.SaveJob(job)).Should(Succeed())
+			if fileManager, err = fm.NewFMWithStore(store); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			Eventually(func() []*fm.Job {
+				jobs, _ := fileManager.ListJobs()
+				return jobs
+			}, 5*time.Second).Should(BeEmpty())
+		}
+
+		// record creates the record the previous run left for the file
+		record := func(status string) *fm.File {
+			file := &fm.File{FilePath: sourceFile, FileName: "file.txt", Source: source, Status: status, Version: 1}
+			Ω(store.CreateFile(file)).Should(Succeed())
+			return file
+		}
+
+		onlyFile := func() *fm.File {
+			files, err := store.ListFiles(&fm.FileFilter{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(files).Should(HaveLen(1))
+			return files[0]
+		}
+
+		It("must drop jobs of imported files", func() {
+			if fileManager, err = fm.NewFMWithStore(store); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			createTestFile(sourceFile)
+			Ω(fileManager.AddWatch(pair)).Should(Succeed())
+
+			Eventually(func() []*fm.File {
+				files, _ := store.ListFiles(&fm.FileFilter{Status: fm.FileStatuses[fm.ValidFile]})
+				return files
+			}, 5*time.Second).Should(HaveLen(1))
+			Eventually(func() []*fm.Job {
+				jobs, _ := fileManager.ListJobs()
+				return jobs
+			}).Should(BeEmpty())
+		})
+
+		It("must import files queued by a previous run", func() {
+			createTestFile(sourceFile)
+			job, err := fm.NewJob(sourceFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			restart(job)
+			Ω(onlyFile().Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(targetFile).Should(BeAnExistingFile())
+		})
+
+		It("must not record a file twice", func() {
+			createTestFile(sourceFile)
+			file := record(fm.FileStatuses[fm.DetectedFile])
+			job, _ := fm.NewJob(sourceFile, pair)
+			job.Status, job.FileId = fm.JobRunning, file.Id
+
+			restart(job)
+			file = onlyFile()
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile))
+		})
+
+		It("must finish a move the record is behind of", func() {
+			createTestFile(targetFile)
+			file := record(fm.FileStatuses[fm.MovingFile])
+			job, _ := fm.NewJob(sourceFile, pair)
+			job.Status, job.FileId, job.Target = fm.JobRunning, file.Id, targetFile
+
+			restart(job)
+			file = onlyFile()
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile))
+
+			files, _ := ioutil.ReadDir(target)
+			Ω(files).Should(HaveLen(1))
+		})
+
+		It("must not touch files imported already", func() {
+			createTestFile(targetFile)
+			file := record(fm.FileStatuses[fm.ValidFile])
+			job, _ := fm.NewJob(sourceFile, pair)
+			job.FileId = file.Id
+
+			restart(job)
+			Ω(onlyFile().Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+		})
+	})
+
+	Describe("Retries", func() {
+		source, target := "tmp/source6", "tmp/target6"
+		sourceFile, targetFile := filepath.Join(source, "file.txt"), filepath.Join(target, "file.txt")
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{source, target} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			// a directory in the way of the target makes the move fail
+			os.MkdirAll(targetFile, os.ModePerm)
+			os.MkdirAll(source, os.ModePerm)
+			createTestFile(sourceFile)
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		jobs := func() []*fm.Job {
+			jobs, _ := fileManager.ListJobs()
+			return jobs
+		}
+
+		onlyJob := func() *fm.Job {
+			if jobs := jobs(); len(jobs) == 1 {
+				return jobs[0]
+			}
+			return &fm.Job{}
+		}
+
+		fileStatus := func() string {
+			files, _ := fileManager.ListFiles(&fm.FileFilter{Source: source})
+			if len(files) != 1 {
+				return ""
+			}
+			return files[0].Status
+		}
+
+		It("must retry failed moves", func() {
+			retry := fm.RetryPolicy{MaxAttempts: 3, Backoff: time.Second}
+			Ω(fileManager.AddWatch(fm.WatchPair{Source: source, Target: target, SkipNaming: true, Layout: fm.LayoutMirror, Retry: retry})).Should(Succeed())
+
+			Eventually(func() int { return onlyJob().Attempts }, 5*time.Second).Should(Equal(1))
+			job := onlyJob()
+			Ω(job.Status).Should(Equal(fm.JobQueued))
+			Ω(job.Error).ShouldNot(BeEmpty())
+			Ω(fileStatus()).Should(Equal(fm.FileStatuses[fm.MovingFile]))
+
+			os.Remove(targetFile)
+			Eventually(fileStatus, 5*time.Second).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(targetFile).Should(BeAnExistingFile())
+			Eventually(jobs).Should(BeEmpty())
+		})
+
+		It("must fail files out of attempts until retried", func() {
+			retry := fm.RetryPolicy{MaxAttempts: 2, Backoff: 100 * time.Millisecond, Jitter: 0.5}
+			Ω(fileManager.AddWatch(fm.WatchPair{Source: source, Target: target, SkipNaming: true, Layout: fm.LayoutMirror, Retry: retry})).Should(Succeed())
+
+			Eventually(func() string { return onlyJob().Status }, 5*time.Second).Should(Equal(fm.JobFailed))
+			job := onlyJob()
+			Ω(job.Attempts).Should(Equal(2))
+			Ω(fileStatus()).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+
+			_, err := fileManager.RetryJob("nope")
+			Ω(err).Should(HaveOccurred())
+
+			os.Remove(targetFile)
+			_, err = fileManager.RetryJob(job.Id)
+			Ω(err).ShouldNot(HaveOccurred())
+			Eventually(fileStatus, 5*time.Second).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Eventually(jobs).Should(BeEmpty())
+
+			_, err = fileManager.RetryJob(job.Id)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Cross-filesystem moves", func() {
+		source, target := "tmp/source7", "/dev/shm/mms-target7"
+		sourceFile, targetFile := filepath.Join(source, "lesson.bin"), filepath.Join(target, "lesson.bin")
+		pair := fm.WatchPair{Source: source, Target: target, SkipNaming: true}
+
+		BeforeEach(func() {
+			for _, dir := range []string{source, target} {
+				os.RemoveAll(dir)
+				os.MkdirAll(dir, os.ModePerm)
+			}
+
+			// a rename that works means target is on the same filesystem
+			probe := filepath.Join(source, "probe")
+			createTestFile(probe)
+			if os.Rename(probe, filepath.Join(target, "probe")) == nil {
+				os.RemoveAll(target)
+				Skip("no second filesystem at " + filepath.Dir(target))
+			}
+			os.Remove(probe)
+
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+		})
+
+		AfterEach(func() {
+			if fileManager != nil {
+				fileManager.Destroy()
+				fileManager = nil
+			}
+			os.RemoveAll(target)
+		})
+
+		It("must copy, verify and remove the source", func() {
+			data := make([]byte, 3<<20)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			Ω(ioutil.WriteFile(sourceFile, data, 0644)).Should(Succeed())
+
+			file, err := fileManager.Import(sourceFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile))
+
+			copied, err := ioutil.ReadFile(targetFile)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(copied).Should(Equal(data))
+			_, err = os.Stat(sourceFile)
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			events, _ := fileManager.FileHistory(file.Id)
+			actions := []string{}
+			for _, event := range events {
+				actions = append(actions, event.Action)
+			}
+			Ω(actions).Should(ContainElement(fm.EventDeleted))
+
+			// no temporary files are left behind
+			files, _ := ioutil.ReadDir(target)
+			Ω(files).Should(HaveLen(1))
+			Ω(fileManager.QueueStats().Moves).Should(BeEmpty())
+		})
+	})
+
+	Describe("Delivery modes", func() {
+		source, target, inbox, backup := "tmp/source8", "tmp/target8", "tmp/inbox8", "tmp/backup8"
+		sourceFile := filepath.Join(source, "file.txt")
+		targets := []fm.PairTarget{{Path: inbox}, {Path: backup}}
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{source, target, inbox, backup} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+			}
+			os.MkdirAll(source, os.ModePerm)
+			Ω(ioutil.WriteFile(sourceFile, []byte("lesson"), 0644)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		It("must reject bad modes and targets", func() {
+			for _, pair := range []fm.WatchPair{
+				{Source: source, Target: target, Mode: "teleport"},
+				{Source: source, Target: target, Targets: []fm.PairTarget{{}}},
+				{Source: source, Target: target, Targets: []fm.PairTarget{{Path: filepath.Join(source, "inbox")}}},
+				{Source: source, Target: target, Targets: []fm.PairTarget{{Path: inbox}, {Path: inbox + "/"}}},
+			} {
+				_, err := fileManager.Import(sourceFile, pair)
+				Ω(err).Should(HaveOccurred())
+			}
+		})
+
+		It("must copy files to every target and keep the source", func() {
+			file, err := fileManager.Import(sourceFile, fm.WatchPair{Source: source, Target: target, SkipNaming: true, Mode: fm.ModeCopy, Targets: targets})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(filepath.Join(target, "file.txt")))
+			Ω(sourceFile).Should(BeAnExistingFile())
+
+			Ω(file.Deliveries).Should(HaveLen(3))
+			for _, d := range file.Deliveries {
+				Ω(d.Status).Should(Equal(fm.DeliveryDelivered))
+				Ω(d.Mode).Should(Equal(fm.ModeCopy))
+				Ω(d.Path).Should(BeAnExistingFile())
+			}
+
+			stored, _ := fileManager.FindFileById(file.Id)
+			Ω(stored.Deliveries).Should(Equal(file.Deliveries))
+		})
+
+		It("must not deliver a kept source twice", func() {
+			pair := fm.WatchPair{Source: source, Target: target, SkipNaming: true, Mode: fm.ModeCopy}
+			file, err := fileManager.Import(sourceFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			again, err := fileManager.Import(sourceFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again.Id).Should(Equal(file.Id))
+
+			files, _ := ioutil.ReadDir(target)
+			Ω(files).Should(HaveLen(1))
+		})
+
+		It("must not import a failed file left in the source again", func() {
+			os.MkdirAll(target, os.ModePerm)
+			Ω(ioutil.WriteFile(filepath.Join(target, "file.txt"), []byte("taken"), 0644)).Should(Succeed())
+			pair := fm.WatchPair{Source: source, Target: target, SkipNaming: true, Conflict: fm.ConflictFail}
+
+			file, err := fileManager.Import(sourceFile, pair)
+			Ω(err).Should(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+
+			again, err := fileManager.Import(sourceFile, pair)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again.Id).Should(Equal(file.Id))
+		})
+
+		It("must import a new file at the path of a kept source", func() {
+			err = fileManager.AddWatch(fm.WatchPair{
+				Source:       source,
+				Target:       target,
+				SkipNaming:   true,
+				Mode:         fm.ModeCopy,
+				Conflict:     fm.ConflictRename,
+				Watcher:      fm.PollWatcher,
+				PollInterval: 200 * time.Millisecond,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			delivered := func() int {
+				files, _ := ioutil.ReadDir(target)
+				return len(files)
+			}
+			Eventually(delivered, 3*time.Second).Should(Equal(1))
+			Consistently(delivered, time.Second).Should(Equal(1))
+
+			Ω(ioutil.WriteFile(sourceFile, []byte("lesson 2"), 0644)).Should(Succeed())
+			Eventually(delivered, 3*time.Second).Should(Equal(2))
+			Consistently(delivered, time.Second).Should(Equal(2))
+		})
+
+		It("must hard link files", func() {
+			file, err := fileManager.Import(sourceFile, fm.WatchPair{Source: source, Target: target, SkipNaming: true, Mode: fm.ModeHardlink})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+
+			linked, _ := os.Stat(file.FilePath)
+			original, _ := os.Stat(sourceFile)
+			Ω(os.SameFile(linked, original)).Should(BeTrue())
+		})
+
+		Context("with a target failing", func() {
+			// a directory in the way of the copy makes the inbox fail
+			BeforeEach(func() {
+				os.MkdirAll(filepath.Join(inbox, "file.txt"), os.ModePerm)
+			})
+
+			It("must keep the source until required targets have a copy", func() {
+				file, err := fileManager.Import(sourceFile, fm.WatchPair{Source: source, Target: target, SkipNaming: true, Layout: fm.LayoutMirror, Targets: targets})
+				Ω(err).Should(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+				Ω(sourceFile).Should(BeAnExistingFile())
+				Ω(filepath.Join(target, "file.txt")).ShouldNot(BeAnExistingFile())
+
+				Ω(file.Deliveries).Should(HaveLen(2))
+				Ω(file.Deliveries[0].Status).Should(Equal(fm.DeliveryFailed))
+				Ω(file.Deliveries[1].Status).Should(Equal(fm.DeliveryDelivered))
+			})
+
+			It("must not wait for optional targets", func() {
+				targets := []fm.PairTarget{{Path: inbox, Optional: true}, {Path: backup}}
+				file, err := fileManager.Import(sourceFile, fm.WatchPair{Source: source, Target: target, SkipNaming: true, Layout: fm.LayoutMirror, Targets: targets})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+				Ω(sourceFile).ShouldNot(BeAnExistingFile())
+
+				Ω(file.Deliveries).Should(HaveLen(3))
+				Ω(file.Deliveries[0].Status).Should(Equal(fm.DeliveryFailed))
+				Ω(file.Deliveries[0].Error).ShouldNot(BeEmpty())
+				Ω(file.Deliveries[2].Target).Should(Equal(target))
+				Ω(file.Deliveries[2].Mode).Should(Equal(fm.ModeMove))
+			})
+		})
+	})
+
+	Describe("Conflicts", func() {
+		source, target, quarantine := "tmp/source9", "tmp/target9", "tmp/quarantine9"
+		sourceFile, targetFile := filepath.Join(source, "file.txt"), filepath.Join(target, "file.txt")
+
+		BeforeEach(func() {
+			if fileManager, err = fm.NewFMWithStore(fm.NewMemoryStore()); err != nil {
+				Fail(fmt.Sprintf("Unable to initialize FileManager: %v", err))
+			}
+			for _, dir := range []string{source, target, quarantine} {
+				if err = os.RemoveAll(dir); err != nil {
+					Fail(fmt.Sprintf("Unable to remove %s", dir))
+				}
+				os.MkdirAll(dir, os.ModePerm)
+			}
+			Ω(ioutil.WriteFile(sourceFile, []byte("new"), 0644)).Should(Succeed())
+			Ω(ioutil.WriteFile(targetFile, []byte("old"), 0644)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			fileManager.Destroy()
+			fileManager = nil
+		})
+
+		importWith := func(policy string) (*fm.File, error) {
+			return fileManager.Import(sourceFile, fm.WatchPair{Source: source, Target: target, SkipNaming: true, Quarantine: quarantine, Conflict: policy})
+		}
+
+		content := func(path string) string {
+			data, _ := ioutil.ReadFile(path)
+			return string(data)
+		}
+
+		It("must reject unknown policies", func() {
+			_, err := importWith("shrug")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("must keep both files by default", func() {
+			file, err := importWith("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.FilePath).Should(Equal(filepath.Join(target, "file_1.txt")))
+			Ω(file.Deliveries[0].Conflict).Should(Equal(fm.ConflictRename))
+			Ω(content(targetFile)).Should(Equal("old"))
+
+			events, _ := fileManager.FileHistory(file.Id)
+			renamed := []fm.FileEvent{}
+			for _, event := range events {
+				if event.Action == fm.EventRenamed {
+					renamed = append(renamed, *event)
+				}
+			}
+			Ω(renamed).Should(HaveLen(1))
+			Ω(renamed[0].From).Should(Equal("file.txt"))
+			Ω(renamed[0].To).Should(Equal("file_1.txt"))
+		})
+
+		It("must quarantine files whose name is taken", func() {
+			file, err := importWith(fm.ConflictFail)
+			Ω(err).Should(BeAssignableToTypeOf(&fm.ConflictError{}))
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+			Ω(file.FilePath).Should(Equal(filepath.Join(quarantine, "file.txt")))
+			Ω(file.Deliveries[0].Conflict).Should(Equal(fm.ConflictFail))
+			Ω(content(targetFile)).Should(Equal("old"))
+		})
+
+		It("must only overwrite files with the same content", func() {
+			file, err := importWith(fm.ConflictOverwrite)
+			Ω(err).Should(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.FailedFile]))
+			Ω(content(targetFile)).Should(Equal("old"))
+
+			Ω(ioutil.WriteFile(sourceFile, []byte("old"), 0644)).Should(Succeed())
+			file, err = importWith(fm.ConflictOverwrite)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.Status).Should(Equal(fm.FileStatuses[fm.ValidFile]))
+			Ω(file.FilePath).Should(Equal(targetFile))
+			Ω(file.Deliveries[0].Conflict).Should(Equal(fm.ConflictOverwrite))
+		})
+
+		It("must version older files", func() {
+			// the older file was imported too
+			older := filepath.Join(source, "older", "file.txt")
+			os.MkdirAll(filepath.Dir(older), os.ModePerm)
+			os.Rename(targetFile, older)
+			original, err := fileManager.Import(older, fm.WatchPair{Source: source, Target: target, SkipNaming: true})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(original.FilePath).Should(Equal(targetFile))
+
+			file, err := importWith(fm.ConflictVersion)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(file.FilePath).Should(Equal(targetFile))
+			Ω(content(targetFile)).Should(Equal("new"))
+
+			version := filepath.Join(target, ".versions", "file.txt")
+			Ω(content(version)).Should(Equal("old"))
+			Ω(file.Deliveries[0].Conflict).Should(Equal(fm.ConflictVersion))
+			Ω(file.Deliveries[0].Version).Should(Equal(version))
+
+			original, _ = fileManager.FindFileById(original.Id)
+			Ω(original.FilePath).Should(Equal(version))
+		})
+	})
 })
@@ -0,0 +1,74 @@
+package file_manager
+
+import "fmt"
+
+// Imports the file at path as if it was found in the pair's source.
+// Returns the record even if the import failed on the way.
+func (fm *FileManager) Import(path string, pair WatchPair) (*File, error) {
+	if err := pair.validate(); err != nil {
+		return nil, err
+	}
+	if err := pair.makeTargets(); err != nil {
+		return nil, err
+	}
+	return fm.importFile(path, &pair, nil)
+}
+
+/*
+ * Runs a file through the import again: a FAILED file is detected again and
+ * delivered to the pair's target, an INVALID one is validated again, after
+ * moving it to the target if it was quarantined. Other files are rejected.
+ */
+func (fm *FileManager) Reprocess(id string, pair WatchPair) (*File, error) {
+	file, err := fm.findPairFile(id, &pair)
+	if err != nil {
+		return file, err
+	}
+	return file, fm.reprocess(file, &pair)
+}
+
+// findPairFile validates the pair and returns the file with id
+func (fm *FileManager) findPairFile(id string, pair *WatchPair) (*File, error) {
+	if err := pair.validate(); err != nil {
+		return nil, err
+	}
+
+	file, err := fm.FindFileById(id)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, fmt.Errorf("file %q not found", id)
+	}
+	return file, nil
+}
+
+func (fm *FileManager) reprocess(file *File, pair *WatchPair) error {
+	if pair.quarantined(file) {
+		removeSidecar(file)
+	}
+
+	switch file.Status {
+	case FileStatuses[InvalidFile]:
+		if isWithin(pair.Target, file.FilePath) {
+			return fm.validate(file, pair)
+		}
+		// e.g. released from quarantine
+		if err := pair.makeTargets(); err != nil {
+			return err
+		}
+		return fm.deliver(file, pair)
+	case FileStatuses[FailedFile]:
+		if err := pair.makeTargets(); err != nil {
+			return err
+		}
+		file.Error = ""
+		if err := fm.advance(file, DetectedFile, StableFile); err != nil {
+			return err
+		}
+		return fm.deliver(file, pair)
+	default:
+		return fmt.Errorf("file %q is %s, only %s and %s files can be reprocessed",
+			file.Id, file.Status, FileStatuses[FailedFile], FileStatuses[InvalidFile])
+	}
+}
@@ -0,0 +1,265 @@
+package file_manager
+
+import (
+	"os"
+	"time"
+)
+
+// Statuses of jobs
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	// Out of attempts, kept until retried, see RetryJob
+	JobFailed = "failed"
+	// Imported, the job is deleted
+	JobDone = "done"
+)
+
+/*
+ * Job is a file handed over by a watcher. It's kept in the store until the
+ * file is imported, so imports pending or interrupted by a crash are picked
+ * up again by the next NewFM.
+ */
+type Job struct {
+	Id   string `gorethink:"id,omitempty" json:"id,omitempty"`
+	Path string `gorethink:"path" json:"path"`
+	// The watch pair as YAML, see encodeWatch
+	Pair   string `gorethink:"pair" json:"pair"`
+	Status string `gorethink:"status" json:"status"`
+
+	// Record created for the file, once inserted
+	FileId string `gorethink:"file_id,omitempty" json:"file_id,omitempty"`
+	// Where the file is being moved, set before it's renamed
+	Target string `gorethink:"target,omitempty" json:"target,omitempty"`
+
+	// Failed attempts are retried following the pair's RetryPolicy
+	Attempts    int       `gorethink:"attempts" json:"attempts"`
+	Error       string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	NextAttempt time.Time `gorethink:"next_attempt" json:"next_attempt"`
+
+	CreatedAt time.Time `gorethink:"created_at" json:"created_at"`
+	UpdatedAt time.Time `gorethink:"updated_at" json:"updated_at"`
+}
+
+// NewJob returns a queued job importing the file at path with the pair
+func NewJob(path string, pair WatchPair) (*Job, error) {
+	data, err := encodeWatch(&pair)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Job{Path: path, Pair: data, Status: JobQueued, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// ListJobs returns the files waiting for or being imported, oldest first
+func (fm *FileManager) ListJobs() ([]*Job, error) {
+	jobs, err := fm.store.ListJobs()
+	if err != nil {
+		l.Println(err)
+	}
+	return jobs, err
+}
+
+// FindJob returns the job with id, nil if there's none
+func (fm *FileManager) FindJob(id string) (*Job, error) {
+	// there are never many jobs
+	jobs, err := fm.ListJobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.Id == id {
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+// saveJob records the progress of job, failing to do so only
+// costs the chance to resume it
+func (fm *FileManager) saveJob(job *Job) {
+	if job == nil {
+		return
+	}
+	job.UpdatedAt = time.Now()
+	if err := fm.store.SaveJob(job); err != nil {
+		l.Printf("Unable to save job of %q: %v", job.Path, err)
+	}
+}
+
+// queueJob records the update before it's queued
+func (fm *FileManager) queueJob(u *updateMsg) {
+	job, err := NewJob(u.file, *u.pair)
+	if err != nil {
+		l.Printf("Unable to record job of %q: %v", u.file, err)
+		return
+	}
+	fm.saveJob(job)
+	u.job = job
+}
+
+// replayJobs queues the jobs left in the store by a previous run
+func (fm *FileManager) replayJobs(b *backlog) {
+	jobs, err := fm.store.ListJobs()
+	if err != nil {
+		l.Println("Unable to read pending jobs", err)
+		return
+	}
+	if len(jobs) > 0 {
+		l.Printf("Replaying %d pending jobs", len(jobs))
+	}
+
+	for _, job := range jobs {
+		pair, err := decodeWatch(job.Pair)
+		if err != nil {
+			l.Printf("Dropping job of %q, bad watch pair: %v", job.Path, err)
+			fm.deleteJob(job)
+			continue
+		}
+
+		u := updateMsg{job.Path, pair, job}
+		b.files[job.Path] = u
+		switch {
+		case job.Status == JobFailed:
+			b.failed[job.Id] = u
+		case job.NextAttempt.After(time.Now()):
+			b.waiting = append(b.waiting, u)
+		default:
+			fm.pool.push(u)
+		}
+	}
+}
+
+func (fm *FileManager) deleteJob(job *Job) {
+	if job == nil || job.Id == "" {
+		return
+	}
+	if err := fm.store.DeleteJob(job.Id); err != nil {
+		l.Printf("Unable to delete job of %q: %v", job.Path, err)
+	}
+}
+
+/*
+ * Makes an attempt to import the file of the job. Jobs are deleted once
+ * done, unless the attempt failed for a transient reason: then the job is
+ * queued for another attempt, or failed when it runs out of attempts.
+ */
+func (fm *FileManager) runJob(u updateMsg) error {
+	job := u.job
+	if job == nil {
+		_, err := fm.importFile(u.file, u.pair, nil)
+		return err
+	}
+
+	job.Attempts++
+	job.Status = JobRunning
+	fm.saveJob(job)
+
+	err := fm.attemptJob(u)
+	if !isTransient(err) {
+		job.Status = JobDone
+		fm.deleteJob(job)
+		return err
+	}
+
+	job.Error = err.Error()
+	if job.retries(u.pair) {
+		job.Status = JobQueued
+		job.NextAttempt = time.Now().Add(u.pair.Retry.backoff(job.Attempts))
+		l.Printf("Attempt %d of %q failed, retrying at %s", job.Attempts, job.Path, job.NextAttempt.Format(time.RFC3339))
+	} else {
+		job.Status = JobFailed
+		l.Printf("Giving up %q after %d attempts", job.Path, job.Attempts)
+	}
+	fm.saveJob(job)
+	return err
+}
+
+// attemptJob imports the file of the job, or finishes the import
+// an earlier attempt started
+func (fm *FileManager) attemptJob(u updateMsg) error {
+	if u.job.FileId != "" {
+		file, err := fm.FindFileById(u.job.FileId)
+		if err != nil {
+			return &TransientError{err}
+		}
+		if file != nil {
+			file.job = u.job
+			return fm.resume(file, u.pair)
+		}
+		l.Printf("Record %s of %q is gone, importing it again", u.job.FileId, u.file)
+		u.job.FileId, u.job.Target = "", ""
+	}
+
+	_, err := fm.importFile(u.file, u.pair, u.job)
+	return err
+}
+
+/*
+ * Takes an import interrupted by a crash or a failed attempt up from the
+ * status the record was left in. The file isn't recorded or moved twice:
+ * a file found at the target of the job was moved and only the record is
+ * behind.
+ */
+func (fm *FileManager) resume(file *File, pair *WatchPair) error {
+	l.Printf("Resuming import of %s, %s", file.FilePath, file.Status)
+
+	switch statusName(statusIndex(file.Status)) {
+	case FileStatuses[DetectedFile]:
+		if err := fm.Transition(file, StableFile); err != nil {
+			return err
+		}
+		return fm.deliver(file, pair)
+	case FileStatuses[StableFile]:
+		return fm.deliver(file, pair)
+	case FileStatuses[MovingFile]:
+		return fm.resumeMove(file, pair)
+	case FileStatuses[MovedFile], FileStatuses[ValidatingFile]:
+		return fm.validate(file, pair)
+	case FileStatuses[FailedFile]:
+		// failed on an earlier attempt and retried since
+		return fm.reprocess(file, pair)
+	}
+
+	// finished already
+	return nil
+}
+
+func (fm *FileManager) resumeMove(file *File, pair *WatchPair) error {
+	job := file.job
+	_, err := os.Stat(file.FilePath)
+	inSource := err == nil
+
+	if job.Target != "" && job.Target != file.FilePath {
+		if info, err := os.Stat(job.Target); err == nil {
+			switch {
+			case !inSource:
+				fm.logMove(file, file.FilePath, job.Target, "resumed", nil)
+				file.FilePath = job.Target
+			case info.Size() == 0:
+				// reserved, but not renamed yet
+				os.Remove(job.Target)
+			case file.verifyChecksums(job.Target) == nil:
+				// copied to another filesystem, but the source is left
+				if pair.mode() == ModeMove {
+					err := os.Remove(file.FilePath)
+					fm.logEvent(file, EventDeleted, file.FilePath, "", "copied to "+job.Target, err)
+				}
+				fm.logMove(file, file.FilePath, job.Target, "resumed", nil)
+				file.FilePath = job.Target
+			}
+		}
+	}
+
+	if !isWithin(pair.Target, file.FilePath) {
+		if err := fm.deliverFile(file, pair); err != nil {
+			return fm.failOrRetry(file, pair, err)
+		}
+	}
+
+	if err := fm.Transition(file, MovedFile); err != nil {
+		return err
+	}
+	return fm.validate(file, pair)
+}
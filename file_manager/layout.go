@@ -0,0 +1,78 @@
+package file_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Put files directly in the target directory (default)
+	LayoutFlatten = "flatten"
+	// Keep the path of the file relative to the source directory
+	LayoutMirror = "mirror"
+)
+
+func validateLayout(layout, source string) error {
+	switch layout {
+	case "", LayoutFlatten, LayoutMirror:
+		return nil
+	default:
+		return fmt.Errorf("unknown layout %q for %q", layout, source)
+	}
+}
+
+// targetPath returns where the file goes in the pair's target, names
+// already taken are resolved by claimTarget
+func (pair *WatchPair) targetPath(file *File) (string, error) {
+	rel := filepath.Base(file.FilePath)
+	switch {
+	case pair.TargetTemplate != "":
+		var err error
+		if rel, err = pair.expandTemplate(file); err != nil {
+			return "", err
+		}
+	case pair.Layout == LayoutMirror:
+		// files imported from elsewhere go to the top of the target
+		if isWithin(pair.Source, file.FilePath) {
+			rel, _ = filepath.Rel(pair.Source, file.FilePath)
+		}
+	}
+
+	target := filepath.Join(pair.Target, rel)
+	return target, os.MkdirAll(filepath.Dir(target), os.ModePerm)
+}
+
+// reservePath creates an empty file at path, or at path with a _1, _2...
+// suffix if taken, so concurrent imports never pick the same name.
+func reservePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := path[:len(path)-len(ext)]
+	for i := 1; ; i++ {
+		if reserved, err := reserve(path); err != nil {
+			return "", err
+		} else if reserved {
+			return path, nil
+		}
+		path = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// reserve creates an empty file at path unless it's taken
+func reserve(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		return true, f.Close()
+	}
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// isWithin reports whether path is inside dir
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
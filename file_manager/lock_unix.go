@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package file_manager
+
+import (
+	"os"
+	"syscall"
+)
+
+// isLocked reports whether another process holds a lock on path.
+// flock locks are advisory, so writers that don't lock aren't detected.
+func isLocked(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return true
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
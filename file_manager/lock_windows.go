@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package file_manager
+
+import "os"
+
+// isLocked reports whether another process holds path open without
+// sharing it for writing.
+func isLocked(path string) bool {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return true
+	}
+	f.Close()
+	return false
+}
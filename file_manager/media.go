@@ -0,0 +1,86 @@
+package file_manager
+
+import (
+	"fmt"
+	"github.com/Bnei-Baruch/mms-file-manager/media"
+)
+
+// Rules for the metadata of MP3, MP4 and MKV files, checked on validation.
+// Files of other formats aren't checked.
+type MediaRules struct {
+	// Mark media files as invalid if their metadata can't be read,
+	// their duration is zero or they break one of the rules below
+	Validate bool `yaml:"validate" json:"validate"`
+
+	// Tags that must not be empty, e.g. title, artist, language
+	RequiredTags []string `yaml:"required_tags" json:"required_tags"`
+
+	// Kbit/s, 0 for no limit
+	MinBitrate int `yaml:"min_bitrate" json:"min_bitrate"`
+	MaxBitrate int `yaml:"max_bitrate" json:"max_bitrate"`
+}
+
+func (rules *MediaRules) validate(source string) error {
+	if rules.MinBitrate < 0 || rules.MaxBitrate < 0 {
+		return fmt.Errorf("bitrates of %q must not be negative", source)
+	}
+	if rules.MaxBitrate > 0 && rules.MinBitrate > rules.MaxBitrate {
+		return fmt.Errorf("min_bitrate of %q is above max_bitrate", source)
+	}
+	return nil
+}
+
+// check returns the rule info breaks, if any
+func (rules *MediaRules) check(info *media.Info) error {
+	if info.Duration <= 0 {
+		return &MediaError{"duration is zero"}
+	}
+	for _, tag := range rules.RequiredTags {
+		if info.Tags[tag] == "" {
+			return &MediaError{fmt.Sprintf("tag %q is missing", tag)}
+		}
+	}
+	if info.Bitrate < rules.MinBitrate {
+		return &MediaError{fmt.Sprintf("bitrate %d kbit/s is below %d", info.Bitrate, rules.MinBitrate)}
+	}
+	if rules.MaxBitrate > 0 && info.Bitrate > rules.MaxBitrate {
+		return &MediaError{fmt.Sprintf("bitrate %d kbit/s is above %d", info.Bitrate, rules.MaxBitrate)}
+	}
+	return nil
+}
+
+/*
+ * Reads the metadata of a media file into file.Media. Returns an error only
+ * if the rules are enforced and the metadata can't be read or breaks them.
+ */
+func (fm *FileManager) checkMedia(file *File, rules *MediaRules) error {
+	if media.Format(file.FilePath) == "" {
+		return nil
+	}
+
+	info, err := media.Probe(file.FilePath)
+	if err == nil {
+		file.Media = info
+	} else {
+		file.Media = nil
+		l.Printf("Unable to read metadata of %s: %v", file.FileName, err)
+	}
+
+	if !rules.Validate {
+		return nil
+	}
+	if err == nil {
+		err = rules.check(info)
+	}
+	fm.logEvent(file, EventValidated, "", "", "media", err)
+	return err
+}
+
+// MediaError is returned when the metadata of a file breaks the rules
+type MediaError struct {
+	Reason string
+}
+
+func (e *MediaError) Error() string {
+	return "invalid media: " + e.Reason
+}
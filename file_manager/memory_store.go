@@ -0,0 +1,281 @@
+package file_manager
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps records in memory only. Records are copied in and out,
+// so callers can't change stored records behind the store's back.
+type memoryStore struct {
+	sync.RWMutex
+	files      map[string]*File
+	events     map[string][]*FileEvent
+	watches    map[string]string
+	deliveries map[string]*WebhookDelivery
+	jobs       map[string]*Job
+}
+
+func NewMemoryStore() FileStore {
+	return &memoryStore{
+		files:      make(map[string]*File),
+		events:     make(map[string][]*FileEvent),
+		watches:    make(map[string]string),
+		deliveries: make(map[string]*WebhookDelivery),
+		jobs:       make(map[string]*Job),
+	}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (s *memoryStore) CreateFile(file *File) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if file.Id == "" {
+		file.Id = newId()
+	} else if _, ok := s.files[file.Id]; ok {
+		return fmt.Errorf("duplicate primary key %q", file.Id)
+	}
+
+	s.files[file.Id] = cloneFile(file)
+	return nil
+}
+
+// cloneFile returns a copy of file that shares nothing mutable with it
+func cloneFile(file *File) *File {
+	f := *file
+	f.Deliveries = append([]TargetDelivery(nil), file.Deliveries...)
+	if file.Media != nil {
+		m := *file.Media
+		if file.Media.Tags != nil {
+			m.Tags = make(map[string]string, len(file.Media.Tags))
+			for k, v := range file.Media.Tags {
+				m.Tags[k] = v
+			}
+		}
+		f.Media = &m
+	}
+	f.job = nil
+	return &f
+}
+
+func (s *memoryStore) FindFileById(id string) (*File, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if f, ok := s.files[id]; ok {
+		return cloneFile(f), nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) FindFileByName(fileName string) (*File, error) {
+	files := s.sorted(func(f *File) bool { return f.FileName == fileName })
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return files[0], nil
+}
+
+func (s *memoryStore) FindFilesByChecksum(algorithm, sum string) ([]*File, error) {
+	return s.sorted(func(f *File) bool { return f.checksums()[algorithm] == sum }), nil
+}
+
+func (s *memoryStore) FindFilesByPath(filePath string) ([]*File, error) {
+	return s.sorted(func(f *File) bool { return f.FilePath == filePath }), nil
+}
+
+func (s *memoryStore) UpdateStatus(file *File, from string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.files[file.Id]
+	if !ok || stored.Status != from {
+		return ErrStatusChanged
+	}
+
+	s.files[file.Id] = cloneFile(file)
+	return nil
+}
+
+func (s *memoryStore) ListFiles(filter *FileFilter) ([]*File, error) {
+	files := s.sorted(filter.match)
+
+	return filter.page(files), nil
+}
+
+// sorted returns copies of the records matching the predicate, oldest first
+func (s *memoryStore) sorted(match func(*File) bool) []*File {
+	s.RLock()
+	defer s.RUnlock()
+
+	files := []*File{}
+	for _, f := range s.files {
+		if match(f) {
+			files = append(files, cloneFile(f))
+		}
+	}
+	sort.Sort(filesByCreation(files))
+	return files
+}
+
+func (s *memoryStore) AddEvent(event *FileEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	event.Id = newId()
+	e := *event
+	s.events[event.FileId] = append(s.events[event.FileId], &e)
+	return nil
+}
+
+func (s *memoryStore) FileEvents(fileId string) ([]*FileEvent, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	events := make([]*FileEvent, 0, len(s.events[fileId]))
+	for _, e := range s.events[fileId] {
+		event := *e
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+func (s *memoryStore) SaveWatch(pair *WatchPair) error {
+	data, err := encodeWatch(pair)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.watches[pair.Source] = data
+	return nil
+}
+
+func (s *memoryStore) DeleteWatch(source string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.watches, source)
+	return nil
+}
+
+func (s *memoryStore) ListWatches() ([]*WatchPair, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	pairs := make([]*WatchPair, 0, len(s.watches))
+	for _, data := range s.watches {
+		pair, err := decodeWatch(data)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+func (s *memoryStore) SaveDelivery(delivery *WebhookDelivery) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if delivery.Id == "" {
+		delivery.Id = newId()
+	}
+	d := *delivery
+	s.deliveries[delivery.Id] = &d
+	return nil
+}
+
+func (s *memoryStore) ClaimDelivery(delivery *WebhookDelivery, from string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.deliveries[delivery.Id]
+	if !ok || stored.Claim != from {
+		return ErrDeliveryClaimed
+	}
+	d := *delivery
+	s.deliveries[delivery.Id] = &d
+	return nil
+}
+
+func (s *memoryStore) PendingDeliveries() ([]*WebhookDelivery, error) {
+	return s.sortedDeliveries(func(d *WebhookDelivery) bool { return d.Status == DeliveryPending }), nil
+}
+
+func (s *memoryStore) FileDeliveries(fileId string) ([]*WebhookDelivery, error) {
+	return s.sortedDeliveries(func(d *WebhookDelivery) bool { return d.FileId == fileId }), nil
+}
+
+func (s *memoryStore) sortedDeliveries(match func(*WebhookDelivery) bool) []*WebhookDelivery {
+	s.RLock()
+	defer s.RUnlock()
+
+	deliveries := []*WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if match(d) {
+			delivery := *d
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+	sort.Sort(deliveriesByCreation(deliveries))
+	return deliveries
+}
+
+func (s *memoryStore) SaveJob(job *Job) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if job.Id == "" {
+		job.Id = newId()
+	}
+	j := *job
+	s.jobs[job.Id] = &j
+	return nil
+}
+
+func (s *memoryStore) DeleteJob(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.jobs, id)
+	return nil
+}
+
+func (s *memoryStore) ListJobs() ([]*Job, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		job := *j
+		jobs = append(jobs, &job)
+	}
+	sort.Sort(jobsByCreation(jobs))
+	return jobs, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+type filesByCreation []*File
+
+func (f filesByCreation) Len() int      { return len(f) }
+func (f filesByCreation) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f filesByCreation) Less(i, j int) bool {
+	if f[i].CreatedAt.Equal(f[j].CreatedAt) {
+		return f[i].Id < f[j].Id
+	}
+	return f[i].CreatedAt.Before(f[j].CreatedAt)
+}
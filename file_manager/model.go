@@ -1,73 +1,176 @@
 package file_manager
 
 import (
-	r "github.com/dancannon/gorethink"
+	"github.com/Bnei-Baruch/mms-file-manager/media"
 	"path/filepath"
 	"time"
 )
 
 type File struct {
-	Id        string    `gorethink:"id,omitempty"`
-	FilePath  string    `gorethink:"file_path"`
-	FileName  string    `gorethink:"file_name"`
-	Status    string    `gorethink:"status"`
-	CreatedAt time.Time `gorethink:"created_at"`
-	UpdatedAt time.Time `gorethink:"updated_at"`
-}
+	Id         string    `gorethink:"id,omitempty" json:"id,omitempty"`
+	FilePath   string    `gorethink:"file_path" json:"file_path"`
+	FileName   string    `gorethink:"file_name" json:"file_name"`
+	Source     string    `gorethink:"source,omitempty" json:"source,omitempty"`
+	SourcePath string    `gorethink:"source_path,omitempty" json:"source_path,omitempty"`
+	Status     string    `gorethink:"status" json:"status"`
+	Error      string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	Size       int64     `gorethink:"size" json:"size"`
+	Md5        string    `gorethink:"md5,omitempty" json:"md5,omitempty"`
+	Sha1       string    `gorethink:"sha1,omitempty" json:"sha1,omitempty"`
+	Sha256     string    `gorethink:"sha256,omitempty" json:"sha256,omitempty"`
+	OriginalId string    `gorethink:"original_id,omitempty" json:"original_id,omitempty"`
+	Version    int       `gorethink:"version" json:"version"`
+	CreatedAt  time.Time `gorethink:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `gorethink:"updated_at" json:"updated_at"`
+
+	// Parsed from the file name, see parseName
+	Language    string    `gorethink:"language,omitempty" json:"language,omitempty"`
+	Original    bool      `gorethink:"original" json:"original"`
+	Lecturer    string    `gorethink:"lecturer,omitempty" json:"lecturer,omitempty"`
+	Date        time.Time `gorethink:"date" json:"date"`
+	ContentType string    `gorethink:"content_type,omitempty" json:"content_type,omitempty"`
+	Description string    `gorethink:"description,omitempty" json:"description,omitempty"`
+	Number      int       `gorethink:"number,omitempty" json:"number,omitempty"`
+	Part        int       `gorethink:"part,omitempty" json:"part,omitempty"`
+
+	// Read on validation from MP3, MP4 and MKV files
+	Media *media.Info `gorethink:"media,omitempty" json:"media,omitempty"`
 
-const fileTableName = "files"
+	// One per target of the pair, see deliverFile
+	Deliveries []TargetDelivery `gorethink:"deliveries,omitempty" json:"deliveries,omitempty"`
+
+	// job importing the file, if any
+	job *Job
+}
 
 const (
-	NewFile = iota
+	DetectedFile = iota
+	StableFile
+	MovingFile
+	MovedFile
+	ValidatingFile
+	ValidFile
 	InvalidFile
+	PublishedFile
+	ArchivedFile
+	FailedFile
 )
 
+// NewFile is what DetectedFile was called before the status lifecycle
+const NewFile = DetectedFile
+
+// Statuses stored by older versions, with the status they stand for
+var legacyStatuses = map[string]int{
+	"NEW": DetectedFile,
+}
+
 var FileStatuses = [...]string{
-	"NEW",
+	"DETECTED",
+	"STABLE",
+	"MOVING",
+	"MOVED",
+	"VALIDATING",
+	"VALID",
 	"INVALID",
+	"PUBLISHED",
+	"ARCHIVED",
+	"FAILED",
 }
 
 func (fm *FileManager) FindOneFile(fileName string) (*File, error) {
-	cursor, err := r.DB(fm.services.DbName).Table(fileTableName).Filter(r.Row.Field("file_name").Eq(fileName)).Run(fm.services.DB)
+	file, err := fm.store.FindFileByName(fileName)
 	if err != nil {
 		l.Println(err)
 		return nil, err
 	}
-	defer cursor.Close()
 
-	if cursor.IsNil() {
+	if file == nil {
 		l.Print("Row not found")
-		return nil, nil
 	}
+	return file, nil
+}
 
-	file := File{}
-	cursor.One(&file)
+func (fm *FileManager) FindFileById(id string) (*File, error) {
+	file, err := fm.store.FindFileById(id)
+	if err != nil {
+		l.Println(err)
+	}
+	return file, err
+}
 
-	return &file, nil
+func (fm *FileManager) ListFiles(filter *FileFilter) ([]*File, error) {
+	files, err := fm.store.ListFiles(filter)
+	if err != nil {
+		l.Println(err)
+	}
+	return files, err
 }
 
+// Hashes the file at filePath and records it. If the same content is already
+// recorded the file is stored as a new version of the original.
 func (fm *FileManager) CreateFileRecord(filePath string) (*File, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			l.Println("Recovered in f", r)
+	file, err := newFile(filePath, defaultChecksums)
+	if err != nil {
+		l.Println("Create file record issue", err)
+		return nil, err
+	}
+
+	if _, err = fm.resolveDuplicate(file, &DuplicatePolicy{}); err != nil {
+		return nil, err
+	}
+
+	if err = fm.insertFile(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Returns all records with the same content as file, oldest first.
+// The strongest checksum present on file is used for the lookup.
+func (fm *FileManager) findSameContent(file *File) ([]*File, error) {
+	for _, algorithm := range []string{SHA256, SHA1, MD5} {
+		if sum := file.checksums()[algorithm]; sum != "" {
+			files, err := fm.store.FindFilesByChecksum(algorithm, sum)
+			if err != nil {
+				l.Println(err)
+			}
+			return files, err
 		}
-	}()
-
-	file := File{
-		FilePath:  filePath,
-		FileName:  filepath.Base(filePath),
-		Status:    FileStatuses[NewFile],
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
 	}
-	res, err := r.Table(fileTableName).Insert(file).RunWrite(fm.services.DB)
+	return nil, nil
+}
 
+// newFile builds a record for the file at filePath with its size and checksums
+func newFile(filePath string, algorithms []string) (*File, error) {
+	size, sums, err := computeChecksums(filePath, algorithms)
 	if err != nil {
-		l.Println("Create file record issue", err, res)
 		return nil, err
 	}
-	file.Id = res.GeneratedKeys[0]
-	l.Println("File was created: ", file)
 
-	return &file, nil
+	file := &File{
+		FilePath:   filePath,
+		FileName:   filepath.Base(filePath),
+		SourcePath: filePath,
+		Status:     FileStatuses[DetectedFile],
+		Version:    1,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	file.setChecksums(size, sums)
+
+	// names are checked on validation if the pair requires it
+	file.parseName()
+	return file, nil
+}
+
+func (fm *FileManager) insertFile(file *File) error {
+	if err := fm.store.CreateFile(file); err != nil {
+		l.Println("Create file record issue", err)
+		return err
+	}
+	l.Println("File was created: ", *file)
+	fm.logEvent(file, EventDetected, "", file.FilePath, "", nil)
+	fm.logEvent(file, EventChecksum, "", "", file.checksumDetails(), nil)
+
+	return nil
 }
@@ -0,0 +1,164 @@
+package file_manager
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// copies of files this large are logged every progressStep percent
+	progressThreshold = 64 << 20
+	progressStep      = 10
+	copyBufferSize    = 1 << 20
+)
+
+// MoveProgress is a file being copied to another filesystem, see moveFile
+type MoveProgress struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+	Copied int64  `json:"copied"`
+}
+
+/*
+ * Moves the file at from to to. Rename doesn't work across filesystems,
+ * e.g. from a local drop directory to a NAS, so then the file is copied to
+ * a temporary name next to to, synced and compared with the source before
+ * it's renamed into place. The source is removed last, a crash on the way
+ * leaves at most a temporary file behind, its removal is recorded on file
+ * if given.
+ */
+func (fm *FileManager) moveFile(file *File, from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+
+	l.Printf("%q and %q are on different filesystems, copying", from, to)
+	if err = fm.copyFile(from, to); err != nil {
+		return err
+	}
+
+	if err = os.Remove(from); err != nil {
+		// the file is in place, only the source is left over
+		l.Printf("Unable to remove %q after copying it to %q: %v", from, to, err)
+	} else if file != nil {
+		fm.logEvent(file, EventDeleted, from, "", "copied to "+to, nil)
+	}
+	return nil
+}
+
+// copyFile copies from to to through a temporary file, see moveFile
+func (fm *FileManager) copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(to), "."+filepath.Base(to)+".")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	progress := fm.pool.startMove(from, to, info.Size())
+	defer fm.pool.endMove(from)
+
+	h := sha1.New()
+	w := &progressWriter{w: io.MultiWriter(tmp, h), progress: progress, pool: fm.pool}
+	if _, err = io.CopyBuffer(w, src, make([]byte, copyBufferSize)); err != nil {
+		return fmt.Errorf("unable to copy %q: %v", from, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// what's on the disk now, not what was written
+	_, sums, err := computeChecksums(tmpPath, []string{SHA1})
+	if err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); sums[SHA1] != sum {
+		return fmt.Errorf("copy of %q is corrupted: %s mismatch, expected %s, got %s", from, SHA1, sum, sums[SHA1])
+	}
+
+	os.Chmod(tmpPath, info.Mode())
+	os.Chtimes(tmpPath, info.ModTime(), info.ModTime())
+	if err = os.Rename(tmpPath, to); err != nil {
+		return err
+	}
+	done = true
+	syncDir(filepath.Dir(to))
+	return nil
+}
+
+// syncDir makes a rename in dir durable where the platform allows it
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// progressWriter counts what's copied and logs it for large files
+type progressWriter struct {
+	w        io.Writer
+	progress *MoveProgress
+	pool     *pool
+	logged   int64
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	copied, size := pw.pool.moved(pw.progress, int64(n))
+
+	if size >= progressThreshold {
+		if percent := copied * 100 / size; percent/progressStep > pw.logged/progressStep {
+			pw.logged = percent
+			l.Printf("Copied %d%% of %q to %q", percent, pw.progress.Path, pw.progress.Target)
+		}
+	}
+	return n, err
+}
+
+func (p *pool) startMove(from, to string, size int64) *MoveProgress {
+	p.Lock()
+	defer p.Unlock()
+	progress := &MoveProgress{Path: from, Target: to, Size: size}
+	p.moves[from] = progress
+	return progress
+}
+
+// moved adds n copied bytes to progress and returns the totals
+func (p *pool) moved(progress *MoveProgress, n int64) (copied, size int64) {
+	p.Lock()
+	defer p.Unlock()
+	progress.Copied += n
+	return progress.Copied, progress.Size
+}
+
+func (p *pool) endMove(from string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.moves, from)
+}
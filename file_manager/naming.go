@@ -0,0 +1,92 @@
+package file_manager
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	languagePattern = regexp.MustCompile(`^[a-z]{3}$`)
+	wordPattern     = regexp.MustCompile(`^[a-z0-9-]+$`)
+	numberPattern   = regexp.MustCompile(`^n(\d+)$`)
+	partPattern     = regexp.MustCompile(`^p(\d+)$`)
+)
+
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%q doesn't follow the naming convention: %s", e.Name, e.Reason)
+}
+
+/*
+ * Parses names of the archive naming convention into the fields of file:
+ *   <language>_<o|t>_<lecturer>_<yyyy-mm-dd>_<content type>[_<description>][_n<number>][_p<part>].<ext>
+ * e.g. heb_o_rav_2015-10-06_lesson_bs-shamati-001_n1_p1.mp4
+ * The fields are left untouched if the name doesn't parse.
+ */
+func (file *File) parseName() error {
+	name := file.FileName
+	fail := func(format string, a ...interface{}) error {
+		return &NameError{name, fmt.Sprintf(format, a...)}
+	}
+
+	parts := strings.Split(strings.TrimSuffix(name, filepath.Ext(name)), "_")
+	if len(parts) < 5 {
+		return fail("expected at least 5 parts separated by _, got %d", len(parts))
+	}
+
+	if !languagePattern.MatchString(parts[0]) {
+		return fail("bad language %q", parts[0])
+	}
+	if parts[1] != "o" && parts[1] != "t" {
+		return fail("expected o for original or t for translation, got %q", parts[1])
+	}
+	if !wordPattern.MatchString(parts[2]) {
+		return fail("bad lecturer %q", parts[2])
+	}
+	date, err := time.Parse("2006-01-02", parts[3])
+	if err != nil {
+		return fail("bad date %q", parts[3])
+	}
+	if !wordPattern.MatchString(parts[4]) {
+		return fail("bad content type %q", parts[4])
+	}
+
+	// number and part are optional suffixes, the rest is the description
+	rest := parts[5:]
+	var number, part int
+	if n := len(rest); n > 0 {
+		if m := partPattern.FindStringSubmatch(rest[n-1]); m != nil {
+			part, _ = strconv.Atoi(m[1])
+			rest = rest[:n-1]
+		}
+	}
+	if n := len(rest); n > 0 {
+		if m := numberPattern.FindStringSubmatch(rest[n-1]); m != nil {
+			number, _ = strconv.Atoi(m[1])
+			rest = rest[:n-1]
+		}
+	}
+	for _, word := range rest {
+		if !wordPattern.MatchString(word) {
+			return fail("bad description %q", strings.Join(rest, "_"))
+		}
+	}
+
+	file.Language = parts[0]
+	file.Original = parts[1] == "o"
+	file.Lecturer = parts[2]
+	file.Date = date
+	file.ContentType = parts[4]
+	file.Description = strings.Join(rest, "_")
+	file.Number = number
+	file.Part = part
+	return nil
+}
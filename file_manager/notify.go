@@ -0,0 +1,274 @@
+package file_manager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNotifyBatch = time.Minute
+	smtpTimeout        = 30 * time.Second
+	// how long Destroy waits for pending notices to be sent
+	notifyCloseTimeout = time.Minute
+)
+
+// Settings of the mails sent to admins when files become invalid or fail
+type NotifyConfig struct {
+	// host:port of the SMTP server, nothing is sent if empty
+	SMTP     string `yaml:"smtp" json:"smtp"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"-"`
+	From     string `yaml:"from" json:"from"`
+
+	// Recipients of all notifications, see WatchPair.Notify
+	To []string `yaml:"to" json:"to"`
+
+	// Notifications are collected this long and sent in one mail per
+	// recipient. Defaults to a minute.
+	Batch time.Duration `yaml:"batch" json:"batch"`
+}
+
+func (c *NotifyConfig) validate() error {
+	if c.SMTP == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.SMTP); err != nil {
+		return fmt.Errorf("bad notify smtp server %q: %v", c.SMTP, err)
+	}
+	if c.From == "" {
+		return fmt.Errorf("%q key is missing in notify", "from")
+	}
+	if c.Batch < 0 {
+		return fmt.Errorf("notify batch must not be negative")
+	}
+	return validateAddresses(append([]string{c.From}, c.To...))
+}
+
+func validateAddresses(addresses []string) error {
+	for _, address := range addresses {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("bad mail address %q: %v", address, err)
+		}
+	}
+	return nil
+}
+
+// notice is a file waiting to be reported
+type notice struct {
+	FileId, FileName, FilePath string
+	Status, Error              string
+	Source, Target             string
+	Time                       time.Time
+}
+
+// notifier batches notices by recipient
+type notifier struct {
+	sync.Mutex
+	fm      *FileManager
+	config  NotifyConfig
+	pending map[string][]notice
+	timer   *time.Timer
+	closed  bool
+	// flushes started by the timer, waited for by close
+	flushes sync.WaitGroup
+}
+
+/*
+ * Sets where admins are notified of invalid and failed files. Notifications
+ * waiting to be sent go out with the new settings. An empty SMTP server
+ * turns notifications off.
+ */
+func (fm *FileManager) SetNotify(config NotifyConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	n := fm.notifier
+	n.Lock()
+	defer n.Unlock()
+	n.config = config
+	return nil
+}
+
+// notify reports the file to the global and the pair's recipients
+func (fm *FileManager) notify(file *File, pair *WatchPair) {
+	n := fm.notifier
+	n.Lock()
+	defer n.Unlock()
+
+	if n.config.SMTP == "" {
+		return
+	}
+	if n.closed {
+		l.Printf("Not notifying of %s, file manager is destroyed", file.FileName)
+		return
+	}
+
+	recipients := make(map[string]bool)
+	for _, to := range append(append([]string{}, n.config.To...), pair.Notify...) {
+		recipients[to] = true
+	}
+
+	nt := notice{
+		FileId:   file.Id,
+		FileName: file.FileName,
+		FilePath: file.FilePath,
+		Status:   file.Status,
+		Error:    file.Error,
+		Source:   pair.Source,
+		Target:   pair.Target,
+		Time:     time.Now(),
+	}
+	for to := range recipients {
+		n.pending[to] = append(n.pending[to], nt)
+	}
+
+	if n.timer == nil && len(recipients) > 0 {
+		batch := n.config.Batch
+		if batch == 0 {
+			batch = defaultNotifyBatch
+		}
+		n.flushes.Add(1)
+		n.timer = time.AfterFunc(batch, func() {
+			defer n.flushes.Done()
+			n.flush(time.Time{})
+		})
+	}
+}
+
+// flush sends the pending notices, the ones left at deadline are dropped.
+// A zero deadline only limits each mail to smtpTimeout.
+func (n *notifier) flush(deadline time.Time) {
+	n.Lock()
+	pending, config := n.pending, n.config
+	n.pending = make(map[string][]notice)
+	n.timer = nil
+	n.Unlock()
+
+	recipients := make([]string, 0, len(pending))
+	for to := range pending {
+		recipients = append(recipients, to)
+	}
+	sort.Strings(recipients)
+
+	for _, to := range recipients {
+		var err error
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			err = fmt.Errorf("out of time")
+		} else {
+			err = sendMail(&config, to, noticeMail(&config, to, pending[to]), deadline)
+		}
+		if err != nil {
+			l.Printf("Unable to notify %s of %d files: %v", to, len(pending[to]), err)
+		}
+		for _, nt := range pending[to] {
+			n.fm.logEvent(&File{Id: nt.FileId}, EventNotified, "", to, nt.Status, err)
+		}
+	}
+}
+
+// close sends what's pending and drops later notices. Returns once a
+// flush the timer started is done too, it logs to the store.
+func (n *notifier) close() {
+	n.Lock()
+	n.closed = true
+	if n.timer != nil && n.timer.Stop() {
+		n.flushes.Done()
+	}
+	n.Unlock()
+	n.flush(time.Now().Add(notifyCloseTimeout))
+	n.flushes.Wait()
+}
+
+func noticeMail(config *NotifyConfig, to string, notices []notice) []byte {
+	subject := fmt.Sprintf("[MMS] %d files need attention", len(notices))
+	if len(notices) == 1 {
+		subject = fmt.Sprintf("[MMS] %s is %s", notices[0].FileName, notices[0].Status)
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	// file names may hold anything, keep them from breaking the header
+	subject = strings.NewReplacer("\r", "", "\n", "").Replace(subject)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	for _, nt := range notices {
+		fmt.Fprintf(msg, "%s is %s\r\n", nt.FileName, nt.Status)
+		fmt.Fprintf(msg, "  reason: %s\r\n", nt.Error)
+		fmt.Fprintf(msg, "  pair:   %s -> %s\r\n", nt.Source, nt.Target)
+		fmt.Fprintf(msg, "  path:   %s\r\n", nt.FilePath)
+		fmt.Fprintf(msg, "  id:     %s\r\n", nt.FileId)
+		fmt.Fprintf(msg, "  time:   %s\r\n", nt.Time.Format(time.RFC3339))
+		fmt.Fprintf(msg, "  host:   %s\r\n\r\n", hostName)
+	}
+	return msg.Bytes()
+}
+
+// sendMail is smtp.SendMail with a timeout, cut short by deadline if set
+func sendMail(config *NotifyConfig, to string, msg []byte, deadline time.Time) error {
+	if limit := time.Now().Add(smtpTimeout); deadline.IsZero() || limit.Before(deadline) {
+		deadline = limit
+	}
+	conn, err := net.DialTimeout("tcp", config.SMTP, deadline.Sub(time.Now()))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(config.SMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if config.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", config.Username, config.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return err
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(rcpt.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,172 @@
+package file_manager
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 10000
+)
+
+// Limits of the imports handed over by the watchers
+type PoolConfig struct {
+	// Files imported at the same time, see WatchPair.Workers for the limit
+	// per pair. Defaults to 4.
+	Workers int `yaml:"workers" json:"workers"`
+
+	// Files waiting for a worker. When the queue is full the watchers wait
+	// before handing over more files. Defaults to 10000.
+	QueueSize int `yaml:"queue_size" json:"queue_size"`
+}
+
+func (c *PoolConfig) validate() error {
+	if c.Workers < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("pool workers and queue_size must not be negative")
+	}
+	return nil
+}
+
+// Snapshot of the import queue
+type QueueStats struct {
+	Workers   int                   `json:"workers"`
+	QueueSize int                   `json:"queue_size"`
+	Queued    int                   `json:"queued"`
+	Running   int                   `json:"running"`
+	Pairs     map[string]*PairStats `json:"pairs"`
+	// Files being copied to another filesystem
+	Moves []MoveProgress `json:"moves"`
+}
+
+// Queue of a watch pair, by source
+type PairStats struct {
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+}
+
+// pool is the queue of the state monitor. Files are started in order,
+// skipping files of pairs that run as many as they may.
+type pool struct {
+	sync.Mutex
+	config  PoolConfig
+	queue   []updateMsg
+	running int
+	pairs   map[string]*PairStats
+	moves   map[string]*MoveProgress
+}
+
+func newPool() *pool {
+	return &pool{pairs: make(map[string]*PairStats), moves: make(map[string]*MoveProgress)}
+}
+
+// Sets the limits of the import queue, see PoolConfig
+func (fm *FileManager) SetPool(config PoolConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	p := fm.pool
+	p.Lock()
+	p.config = config
+	p.Unlock()
+
+	// more workers may start right away
+	fm.wakeMonitor()
+	return nil
+}
+
+// QueueStats returns the length of the import queue and the running imports
+func (fm *FileManager) QueueStats() QueueStats {
+	p := fm.pool
+	p.Lock()
+	defer p.Unlock()
+
+	stats := QueueStats{
+		Workers:   p.workers(),
+		QueueSize: p.queueSize(),
+		Queued:    len(p.queue),
+		Running:   p.running,
+		Pairs:     make(map[string]*PairStats),
+		Moves:     []MoveProgress{},
+	}
+	for source, s := range p.pairs {
+		pair := *s
+		stats.Pairs[source] = &pair
+	}
+	for _, move := range p.moves {
+		stats.Moves = append(stats.Moves, *move)
+	}
+	return stats
+}
+
+func (p *pool) workers() int {
+	if p.config.Workers == 0 {
+		return defaultWorkers
+	}
+	return p.config.Workers
+}
+
+func (p *pool) queueSize() int {
+	if p.config.QueueSize == 0 {
+		return defaultQueueSize
+	}
+	return p.config.QueueSize
+}
+
+// full tells the state monitor to stop taking updates
+func (p *pool) full() bool {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.queue) >= p.queueSize()
+}
+
+func (p *pool) push(u updateMsg) {
+	p.Lock()
+	defer p.Unlock()
+	p.queue = append(p.queue, u)
+	p.pair(u).Queued++
+}
+
+// next takes the first file that may start now, if any
+func (p *pool) next() (updateMsg, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.running >= p.workers() {
+		return updateMsg{}, false
+	}
+	for i, u := range p.queue {
+		pair := p.pair(u)
+		if u.pair.Workers > 0 && pair.Running >= u.pair.Workers {
+			continue
+		}
+
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		pair.Queued--
+		pair.Running++
+		p.running++
+		return u, true
+	}
+	return updateMsg{}, false
+}
+
+func (p *pool) finish(u updateMsg) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.running--
+	pair := p.pair(u)
+	if pair.Running--; pair.Running == 0 && pair.Queued == 0 {
+		delete(p.pairs, u.pair.Source)
+	}
+}
+
+func (p *pool) pair(u updateMsg) *PairStats {
+	s, ok := p.pairs[u.pair.Source]
+	if !ok {
+		s = &PairStats{}
+		p.pairs[u.pair.Source] = s
+	}
+	return s
+}
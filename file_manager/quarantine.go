@@ -0,0 +1,123 @@
+package file_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// a quarantined file <name> is explained by <name>.error.json
+const sidecarSuffix = ".error.json"
+
+// Content of the sidecar of a quarantined file
+type QuarantineReport struct {
+	FileId   string    `json:"file_id"`
+	FileName string    `json:"file_name"`
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+/*
+ * Moves the file to the pair's quarantine dir, if any, saves the new path
+ * and writes a sidecar explaining why the file got its status. Called once
+ * the status is changed, a file that can't be quarantined stays where it is.
+ */
+func (fm *FileManager) quarantine(file *File, pair *WatchPair, reason error) {
+	if pair.Quarantine == "" {
+		return
+	}
+
+	if err := os.MkdirAll(pair.Quarantine, os.ModePerm); err != nil {
+		l.Printf("Unable to quarantine %q: %v", file.FilePath, err)
+		return
+	}
+
+	target, err := reservePath(filepath.Join(pair.Quarantine, file.FileName))
+	if err != nil {
+		l.Printf("Unable to quarantine %q: %v", file.FilePath, err)
+		return
+	}
+
+	from := file.FilePath
+	err = fm.moveFile(file, from, target)
+	fm.logEvent(file, EventQuarantined, from, target, reason.Error(), err)
+	if err != nil {
+		os.Remove(target)
+		l.Printf("Unable to quarantine %q: %v", from, err)
+		return
+	}
+	file.FilePath = target
+	if err = fm.store.UpdateStatus(file, file.Status); err != nil {
+		l.Printf("Unable to save quarantined path of %s, moving it back: %v", file.FileName, err)
+		if err = fm.moveFile(file, target, from); err != nil {
+			l.Printf("Unable to move %q back: %v", target, err)
+			return
+		}
+		file.FilePath = from
+		return
+	}
+
+	data, err := json.MarshalIndent(&QuarantineReport{
+		FileId:   file.Id,
+		FileName: file.FileName,
+		Path:     from,
+		Status:   file.Status,
+		Error:    reason.Error(),
+		Host:     hostName,
+		Time:     time.Now(),
+	}, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(target+sidecarSuffix, data, 0644)
+	}
+	if err != nil {
+		l.Printf("Unable to write sidecar of %q: %v", target, err)
+	}
+}
+
+/*
+ * Takes a file out of the pair's quarantine and runs it through the import
+ * again, see Reprocess. Returns an error only if the file can't be released,
+ * the outcome of the import is in its status.
+ */
+func (fm *FileManager) Release(id string, pair WatchPair) (*File, error) {
+	file, err := fm.findPairFile(id, &pair)
+	if err != nil {
+		return file, err
+	}
+
+	if !pair.quarantined(file) {
+		return file, &QuarantineError{id}
+	}
+
+	l.Println("Releasing", file.FilePath)
+	if err = fm.reprocess(file, &pair); err != nil {
+		l.Printf("Released file %s: %v", file.FileName, err)
+	}
+	return file, nil
+}
+
+func (pair *WatchPair) quarantined(file *File) bool {
+	return pair.Quarantine != "" && isWithin(pair.Quarantine, file.FilePath)
+}
+
+// removeSidecar is called when the file leaves quarantine
+func removeSidecar(file *File) {
+	if err := os.Remove(file.FilePath + sidecarSuffix); err != nil && !os.IsNotExist(err) {
+		l.Printf("Unable to remove sidecar of %q: %v", file.FilePath, err)
+	}
+}
+
+// QuarantineError is returned when releasing a file that isn't quarantined
+type QuarantineError struct {
+	FileId string
+}
+
+func (e *QuarantineError) Error() string {
+	return fmt.Sprintf("file %q is not quarantined", e.FileId)
+}
@@ -0,0 +1,240 @@
+package file_manager
+
+import (
+	"fmt"
+	"gopkg.in/fsnotify.v1"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// editors write the config file in several steps, reload once they're done
+const configReloadDelay = 500 * time.Millisecond
+
+// Reads the config file and validates its watch pairs
+func ReadConfig(configFile string) ([]WatchPair, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return config.Watch, nil
+}
+
+// Sets the notify and webhook settings of the config file without watching
+// its pairs, for one-off commands, see OpenFM. The webhook deliveries are
+// left in the store to the file managers that run.
+func (fm *FileManager) ApplyConfig(configFile string) error {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if err = fm.SetNotify(config.Notify); err != nil {
+		return err
+	}
+	return fm.SetWebhooks(config.Webhooks)
+}
+
+func loadConfig(configFile interface{}) (*configData, error) {
+	config, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	if config.Watch == nil {
+		return nil, fmt.Errorf("%q key not found in config file", "watch")
+	}
+	if err := config.Notify.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Pool.validate(); err != nil {
+		return nil, err
+	}
+	for i := range config.Webhooks {
+		if err := config.Webhooks[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	sources := make(map[string]bool)
+	for _, pair := range config.Watch {
+		if err := pair.validate(); err != nil {
+			return nil, err
+		}
+		if sources[pair.Source] {
+			return nil, fmt.Errorf("directory %q is watched twice in config file", pair.Source)
+		}
+		sources[pair.Source] = true
+	}
+	return config, nil
+}
+
+/*
+ * Re-reads the config file and applies changes of its watch list:
+ * new pairs are watched, removed pairs are unwatched and changed pairs
+ * are restarted. Files already handed over to the state monitor are still
+ * imported. An invalid config, or one with directories that can't be
+ * created, is rejected and running watches are kept.
+ */
+func (fm *FileManager) ReloadConfig() error {
+	fm.configLock.Lock()
+	defer fm.configLock.Unlock()
+
+	select {
+	case <-fm.done:
+		return nil
+	default:
+	}
+
+	if fm.configFile == "" {
+		return fmt.Errorf("file manager was created without config file")
+	}
+
+	config, err := loadConfig(fm.configFile)
+	if err != nil {
+		l.Printf("Rejected config file %q: %v", fm.configFile, err)
+		return err
+	}
+
+	pairs := make(map[string]WatchPair)
+	for _, pair := range config.Watch {
+		pairs[pair.Source] = pair
+	}
+
+	var added, removed, changed []string
+	for source, old := range fm.configPairs {
+		if pair, ok := pairs[source]; !ok {
+			removed = append(removed, source)
+		} else if !reflect.DeepEqual(old, pair) {
+			changed = append(changed, source)
+		}
+	}
+	for source := range pairs {
+		if _, ok := fm.configPairs[source]; !ok {
+			added = append(added, source)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	// new pairs may already be watched, e.g. through the API
+	for _, source := range added {
+		if fm.isWatched(source) {
+			err = &WatchError{source, true}
+			l.Printf("Rejected config file %q: %v", fm.configFile, err)
+			return err
+		}
+	}
+
+	// directories that can't be created reject the config before
+	// anything is stopped
+	for _, source := range append(added, changed...) {
+		pair := pairs[source]
+		if err = os.MkdirAll(pair.Source, os.ModePerm); err == nil {
+			err = pair.makeTargets()
+		}
+		if err != nil {
+			l.Printf("Rejected config file %q: %v", fm.configFile, err)
+			return err
+		}
+	}
+
+	for _, source := range append(removed, changed...) {
+		if err := fm.stopWatch(source); err != nil {
+			l.Printf("Unable to stop watching %q: %v", source, err)
+		}
+	}
+
+	// new pairs that fail to start are left out, so the next reload retries
+	// them. Changed pairs go back to their old settings.
+	var failed error
+	for _, source := range append(added, changed...) {
+		err := fm.AddWatch(pairs[source])
+		if err == nil {
+			continue
+		}
+		l.Printf("Unable to watch %q: %v", source, err)
+		if failed == nil {
+			failed = err
+		}
+
+		old, ok := fm.configPairs[source]
+		if !ok {
+			delete(pairs, source)
+		} else if err = fm.AddWatch(old); err != nil {
+			l.Printf("Unable to watch %q again: %v", source, err)
+			delete(pairs, source)
+		} else {
+			pairs[source] = old
+		}
+	}
+	fm.configPairs = pairs
+	fm.SetNotify(config.Notify)
+	fm.SetWebhooks(config.Webhooks)
+	fm.SetPool(config.Pool)
+
+	l.Printf("Reloaded config file %q: added %v, removed %v, changed %v", fm.configFile, added, removed, changed)
+	return failed
+}
+
+func (fm *FileManager) isWatched(source string) bool {
+	watchDirCacher.Lock()
+	defer watchDirCacher.Unlock()
+
+	_, ok := watchDirCacher.cache[source]
+	return ok
+}
+
+// watchConfig reloads the config file when it's changed or on SIGHUP
+func (fm *FileManager) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// editors often replace the file, so its directory is watched
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(fm.configFile)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		l.Printf("Unable to watch config file %q, reload it with SIGHUP: %v", fm.configFile, err)
+	} else {
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if events != nil {
+			defer watcher.Close()
+		}
+
+		name := filepath.Base(fm.configFile)
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-fm.done:
+				return
+			case <-hup:
+				l.Println("SIGHUP received, reloading config file", fm.configFile)
+				fm.ReloadConfig()
+			case event := <-events:
+				if filepath.Base(event.Name) == name {
+					reload = time.After(configReloadDelay)
+				}
+			case err := <-errs:
+				l.Printf("Config watcher error on %q: %v", fm.configFile, err)
+			case <-reload:
+				reload = nil
+				fm.ReloadConfig()
+			}
+		}
+	}()
+}
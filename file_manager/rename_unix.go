@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package file_manager
+
+import (
+	"os"
+	"syscall"
+)
+
+// crossDevice reports whether a rename failed because the paths are
+// on different filesystems
+func crossDevice(err error) bool {
+	if e, ok := err.(*os.LinkError); ok {
+		err = e.Err
+	}
+	return err == syscall.EXDEV
+}
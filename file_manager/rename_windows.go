@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package file_manager
+
+import (
+	"os"
+	"syscall"
+)
+
+// ERROR_NOT_SAME_DEVICE
+const errNotSameDevice = syscall.Errno(17)
+
+// crossDevice reports whether a rename failed because the paths are
+// on different volumes
+func crossDevice(err error) bool {
+	if e, ok := err.(*os.LinkError); ok {
+		err = e.Err
+	}
+	return err == errNotSameDevice
+}
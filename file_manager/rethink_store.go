@@ -0,0 +1,284 @@
+package file_manager
+
+import (
+	"github.com/Bnei-Baruch/mms-file-manager/config"
+	r "github.com/dancannon/gorethink"
+	"regexp"
+	"strings"
+)
+
+const (
+	fileTableName      = "files"
+	fileEventTableName = "file_events"
+	watchTableName     = "watches"
+	hookTableName      = "webhook_deliveries"
+	jobTableName       = "jobs"
+)
+
+type watchRecord struct {
+	Source string `gorethink:"source"`
+	Config string `gorethink:"config"`
+}
+
+type rethinkStore struct {
+	services *config.Services
+}
+
+func NewRethinkStore(dbName string) (s FileStore, err error) {
+	// NewServices panics if it can't connect
+	defer func() {
+		if e := recover(); e != nil {
+			if err, _ = e.(error); err == nil {
+				panic(e)
+			}
+		}
+	}()
+
+	return &rethinkStore{config.NewServices(dbName)}, nil
+}
+
+func (s *rethinkStore) table(name string) r.Term {
+	return r.DB(s.services.DbName).Table(name)
+}
+
+func (s *rethinkStore) CreateFile(file *File) error {
+	res, err := s.table(fileTableName).Insert(file).RunWrite(s.services.DB)
+	if err != nil {
+		return err
+	}
+	if len(res.GeneratedKeys) > 0 {
+		file.Id = res.GeneratedKeys[0]
+	}
+	return nil
+}
+
+func (s *rethinkStore) FindFileById(id string) (*File, error) {
+	return s.findOne(s.table(fileTableName).Get(id))
+}
+
+func (s *rethinkStore) FindFileByName(fileName string) (*File, error) {
+	return s.findOne(s.table(fileTableName).GetAllByIndex("file_name", fileName).OrderBy("created_at").Limit(1))
+}
+
+func (s *rethinkStore) findOne(query r.Term) (*File, error) {
+	cursor, err := query.Run(s.services.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	file := File{}
+	if err = cursor.One(&file); err != nil {
+		if err == r.ErrEmptyResult {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (s *rethinkStore) FindFilesByChecksum(algorithm, sum string) ([]*File, error) {
+	files := []*File{}
+	if err := s.all(s.table(fileTableName).GetAllByIndex(algorithm, sum).OrderBy("created_at"), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s *rethinkStore) FindFilesByPath(filePath string) ([]*File, error) {
+	files := []*File{}
+	if err := s.all(s.table(fileTableName).GetAllByIndex("file_path", filePath).OrderBy("created_at"), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// raised by UpdateStatus instead of writing a record in another status
+const statusChanged = "file status was changed"
+
+func (s *rethinkStore) UpdateStatus(file *File, from string) error {
+	// replaced as a whole, so fields cleared on file are removed
+	res, err := s.table(fileTableName).Get(file.Id).Replace(func(row r.Term) interface{} {
+		return r.Branch(row.Eq(nil), r.Error(statusChanged), row.Field("status").Eq(from), file, r.Error(statusChanged))
+	}).RunWrite(s.services.DB)
+
+	if res.Errors > 0 && strings.Contains(res.FirstError, statusChanged) {
+		return ErrStatusChanged
+	}
+	if err != nil {
+		return err
+	}
+	// writing the record as it is changes nothing
+	if res.Replaced == 0 && res.Unchanged == 0 {
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func (s *rethinkStore) ListFiles(filter *FileFilter) ([]*File, error) {
+	query := s.table(fileTableName).OrderBy(r.OrderByOpts{Index: "created_at"})
+	if filter.Status != "" {
+		query = query.Filter(r.Expr(statusNames(filter.Status)).Contains(r.Row.Field("status")))
+	}
+	if filter.Source != "" {
+		query = query.Filter(r.Row.Field("source").Eq(filter.Source))
+	}
+	if filter.NameContains != "" {
+		query = query.Filter(func(row r.Term) r.Term {
+			return row.Field("file_name").Match(regexp.QuoteMeta(filter.NameContains))
+		})
+	}
+	if !filter.CreatedAfter.IsZero() {
+		query = query.Filter(r.Row.Field("created_at").Gt(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query = query.Filter(r.Row.Field("created_at").Lt(filter.CreatedBefore))
+	}
+	if filter.Offset > 0 {
+		query = query.Skip(filter.Offset)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	files := []*File{}
+	if err := s.all(query, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (s *rethinkStore) AddEvent(event *FileEvent) error {
+	res, err := s.table(fileEventTableName).Insert(event).RunWrite(s.services.DB)
+	if err != nil {
+		return err
+	}
+	if len(res.GeneratedKeys) > 0 {
+		event.Id = res.GeneratedKeys[0]
+	}
+	return nil
+}
+
+func (s *rethinkStore) FileEvents(fileId string) ([]*FileEvent, error) {
+	events := []*FileEvent{}
+	if err := s.all(s.table(fileEventTableName).GetAllByIndex("file_id", fileId).OrderBy("created_at"), &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *rethinkStore) SaveWatch(pair *WatchPair) error {
+	data, err := encodeWatch(pair)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.table(watchTableName).Insert(watchRecord{pair.Source, data}, r.InsertOpts{Conflict: "replace"}).RunWrite(s.services.DB)
+	return err
+}
+
+func (s *rethinkStore) DeleteWatch(source string) error {
+	_, err := s.table(watchTableName).Get(source).Delete().RunWrite(s.services.DB)
+	return err
+}
+
+func (s *rethinkStore) ListWatches() ([]*WatchPair, error) {
+	records := []*watchRecord{}
+	if err := s.all(s.table(watchTableName), &records); err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*WatchPair, 0, len(records))
+	for _, record := range records {
+		pair, err := decodeWatch(record.Config)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+func (s *rethinkStore) SaveDelivery(delivery *WebhookDelivery) error {
+	res, err := s.table(hookTableName).Insert(delivery, r.InsertOpts{Conflict: "replace"}).RunWrite(s.services.DB)
+	if err != nil {
+		return err
+	}
+	if len(res.GeneratedKeys) > 0 {
+		delivery.Id = res.GeneratedKeys[0]
+	}
+	return nil
+}
+
+func (s *rethinkStore) ClaimDelivery(delivery *WebhookDelivery, from string) error {
+	res, err := s.table(hookTableName).Get(delivery.Id).Replace(func(row r.Term) interface{} {
+		return r.Branch(row.Field("claim").Default("").Eq(from), delivery, row)
+	}).RunWrite(s.services.DB)
+
+	if err != nil {
+		return err
+	}
+	if res.Replaced == 0 {
+		return ErrDeliveryClaimed
+	}
+	return nil
+}
+
+func (s *rethinkStore) PendingDeliveries() ([]*WebhookDelivery, error) {
+	return s.deliveries(s.table(hookTableName).GetAllByIndex("status", DeliveryPending).OrderBy("created_at"))
+}
+
+func (s *rethinkStore) FileDeliveries(fileId string) ([]*WebhookDelivery, error) {
+	return s.deliveries(s.table(hookTableName).GetAllByIndex("file_id", fileId).OrderBy("created_at"))
+}
+
+func (s *rethinkStore) deliveries(query r.Term) ([]*WebhookDelivery, error) {
+	deliveries := []*WebhookDelivery{}
+	if err := s.all(query, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (s *rethinkStore) SaveJob(job *Job) error {
+	res, err := s.table(jobTableName).Insert(job, r.InsertOpts{Conflict: "replace"}).RunWrite(s.services.DB)
+	if err != nil {
+		return err
+	}
+	if len(res.GeneratedKeys) > 0 {
+		job.Id = res.GeneratedKeys[0]
+	}
+	return nil
+}
+
+func (s *rethinkStore) DeleteJob(id string) error {
+	_, err := s.table(jobTableName).Get(id).Delete().RunWrite(s.services.DB)
+	return err
+}
+
+func (s *rethinkStore) ListJobs() ([]*Job, error) {
+	jobs := []*Job{}
+	if err := s.all(s.table(jobTableName).OrderBy("created_at"), &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *rethinkStore) all(query r.Term, result interface{}) error {
+	cursor, err := query.Run(s.services.DB)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	return cursor.All(result)
+}
+
+func (s *rethinkStore) Close() error {
+	s.services.Destroy()
+	return nil
+}
@@ -0,0 +1,216 @@
+package file_manager
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 5
+	defaultRetryBackoff  = 10 * time.Second
+	defaultMaxBackoff    = 10 * time.Minute
+)
+
+// RetryPolicy decides how often a job is attempted when moving its file or
+// writing its record fails. Files breaking the rules of the pair aren't
+// retried, they are invalid.
+type RetryPolicy struct {
+	// Attempts before the job and its file are failed, the first included.
+	// Defaults to 5, 1 turns retries off.
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+
+	// Wait after the first failed attempt, doubling on every further one
+	// up to MaxBackoff. Default to 10 seconds and 10 minutes.
+	Backoff    time.Duration `yaml:"backoff" json:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff" json:"max_backoff"`
+
+	// Part of the wait that is random, e.g. 0.2 waits 80% to 120% of it,
+	// so files failing together aren't retried together
+	Jitter float64 `yaml:"jitter" json:"jitter"`
+}
+
+func (p *RetryPolicy) validate(source string) error {
+	if p.MaxAttempts < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry of %q must not be negative", source)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter of %q must be between 0 and 1", source)
+	}
+	return nil
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return defaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	backoff, max := p.Backoff, p.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return time.Duration(float64(backoff) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// TransientError is an import error worth another attempt, e.g. a move to
+// a target that is down or a record the store failed to write
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func isTransient(err error) bool {
+	_, ok := err.(*TransientError)
+	return ok
+}
+
+// retries reports whether the job gets another attempt with the pair
+func (job *Job) retries(pair *WatchPair) bool {
+	return job != nil && job.Attempts < pair.Retry.maxAttempts()
+}
+
+// failOrRetry fails the file unless its job gets another attempt. Conflicts
+// in the target fail right away, another attempt finds the same files there.
+func (fm *FileManager) failOrRetry(file *File, pair *WatchPair, err error) error {
+	if _, ok := err.(*ConflictError); ok {
+		fm.fail(file, pair, err)
+		return err
+	}
+	if file.job.retries(pair) {
+		l.Printf("File %s will be retried: %v", file.FileName, err)
+	} else {
+		fm.fail(file, pair, err)
+	}
+	return &TransientError{err}
+}
+
+// JobError is returned when retrying a job that hasn't failed
+type JobError struct {
+	JobId  string
+	Status string
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("job %q is %s, only %s jobs can be retried", e.JobId, e.Status, JobFailed)
+}
+
+/*
+ * Queues a failed job again with its attempts reset. The running file
+ * manager takes it up right away if it's this one, otherwise within a few
+ * seconds.
+ */
+func (fm *FileManager) RetryJob(id string) (*Job, error) {
+	job, err := fm.FindJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, fmt.Errorf("job %q not found", id)
+	}
+	if job.Status != JobFailed {
+		return job, &JobError{id, job.Status}
+	}
+
+	l.Println("Retrying job of", job.Path)
+	job.Status, job.Attempts, job.Error = JobQueued, 0, ""
+	job.NextAttempt, job.UpdatedAt = time.Time{}, time.Now()
+	if err = fm.store.SaveJob(job); err != nil {
+		return job, err
+	}
+
+	fm.wakeMonitor()
+	return job, nil
+}
+
+// backlog is what the state monitor knows of jobs that aren't in the pool
+type backlog struct {
+	// paths handed over until their job finished
+	files fileCacher
+	// jobs waiting for their next attempt
+	waiting []updateMsg
+	// jobs out of attempts by id, until retried
+	failed map[string]updateMsg
+}
+
+func newBacklog() *backlog {
+	return &backlog{files: make(fileCacher), failed: make(map[string]updateMsg)}
+}
+
+// finish files the update of a job that just ran
+func (b *backlog) finish(u updateMsg) {
+	switch {
+	case u.job != nil && u.job.Status == JobQueued:
+		b.waiting = append(b.waiting, u)
+	case u.job != nil && u.job.Status == JobFailed:
+		b.failed[u.job.Id] = u
+	default:
+		// a file offered again at the path is a new one or was delivered
+		// already, see findDelivered
+		delete(b.files, u.file)
+	}
+}
+
+// due removes and returns the jobs whose next attempt is due
+func (b *backlog) due(now time.Time) []updateMsg {
+	due, waiting := []updateMsg{}, b.waiting[:0]
+	for _, u := range b.waiting {
+		if u.job.NextAttempt.After(now) {
+			waiting = append(waiting, u)
+		} else {
+			due = append(due, u)
+		}
+	}
+	b.waiting = waiting
+	return due
+}
+
+// next returns when the first waiting job is due
+func (b *backlog) next() (time.Time, bool) {
+	var next time.Time
+	for _, u := range b.waiting {
+		if next.IsZero() || u.job.NextAttempt.Before(next) {
+			next = u.job.NextAttempt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// requeue takes up failed jobs that were retried, see RetryJob
+func (fm *FileManager) requeue(b *backlog) {
+	if len(b.failed) == 0 {
+		return
+	}
+
+	jobs, err := fm.store.ListJobs()
+	if err != nil {
+		l.Println("Unable to read retried jobs", err)
+		return
+	}
+	for _, job := range jobs {
+		u, ok := b.failed[job.Id]
+		if !ok || job.Status != JobQueued {
+			continue
+		}
+
+		delete(b.failed, job.Id)
+		u.job = job
+		b.waiting = append(b.waiting, u)
+	}
+}
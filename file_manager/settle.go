@@ -0,0 +1,138 @@
+package file_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const settleCheckInterval = 500 * time.Millisecond
+
+var defaultIgnorePatterns = []string{"*.part", "*.tmp", "*.filepart"}
+
+// SettlePolicy decides when a file in the source directory is complete
+// enough to be imported.
+type SettlePolicy struct {
+	// File size and modification time must stay unchanged this long
+	Duration time.Duration `yaml:"duration" json:"duration"`
+	// Refuse files another process holds a lock on
+	LockCheck bool `yaml:"lock_check" json:"lock_check"`
+	// Shell patterns matched against the file name. Defaults to
+	// defaultIgnorePatterns if not set.
+	Ignore []string `yaml:"ignore" json:"ignore"`
+}
+
+func (p *SettlePolicy) validate(source string) error {
+	if p.Duration < 0 {
+		return fmt.Errorf("settle duration of %q must not be negative", source)
+	}
+	for _, pattern := range p.Ignore {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad ignore pattern %q for %q: %v", pattern, source, err)
+		}
+	}
+	return nil
+}
+
+func (p *SettlePolicy) enabled() bool {
+	return p.Duration > 0 || p.LockCheck
+}
+
+func (p *SettlePolicy) ignored(path string) bool {
+	patterns := p.Ignore
+	if patterns == nil {
+		patterns = defaultIgnorePatterns
+	}
+
+	name := filepath.Base(path)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// settler holds files until they pass the pair's settle policy
+// and only then sends them to the state monitor.
+type settler struct {
+	w          *dirWatcher
+	candidates chan string
+	pending    map[string]*pendingFile
+}
+
+func newSettler(w *dirWatcher) *settler {
+	return &settler{
+		w:          w,
+		candidates: make(chan string, 1),
+		pending:    make(map[string]*pendingFile),
+	}
+}
+
+func (s *settler) offer(path string) bool {
+	select {
+	case s.candidates <- path:
+		return true
+	case <-s.w.stop:
+		return false
+	}
+}
+
+func (s *settler) run() {
+	ticker := time.NewTicker(settleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.w.stop:
+			return
+		case path := <-s.candidates:
+			if _, ok := s.pending[path]; !ok {
+				s.pending[path] = &pendingFile{}
+				s.check(path, time.Now())
+			}
+		case now := <-ticker.C:
+			for path := range s.pending {
+				if !s.check(path, now) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// check sends path to the state monitor once it has settled.
+// Returns false if the watch was stopped in the meantime.
+func (s *settler) check(path string, now time.Time) bool {
+	p := s.pending[path]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(s.pending, path)
+		return true
+	}
+
+	if info.Size() != p.size || !info.ModTime().Equal(p.modTime) {
+		p.size, p.modTime, p.since = info.Size(), info.ModTime(), now
+		return true
+	}
+
+	policy := &s.w.pair.Settle
+	if now.Sub(p.since) < policy.Duration {
+		return true
+	}
+
+	if policy.LockCheck && isLocked(path) {
+		return true
+	}
+
+	delete(s.pending, path)
+	return s.w.send(path)
+}
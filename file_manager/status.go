@@ -0,0 +1,145 @@
+package file_manager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Legal status transitions, every status may also go to FailedFile.
+// A failed file may be detected again when it is retried, an invalid one
+// is moved again when released from quarantine.
+var transitions = map[int][]int{
+	DetectedFile:   {StableFile},
+	StableFile:     {MovingFile},
+	MovingFile:     {MovedFile},
+	MovedFile:      {ValidatingFile},
+	ValidatingFile: {ValidFile, InvalidFile},
+	ValidFile:      {PublishedFile, ArchivedFile, ValidatingFile},
+	InvalidFile:    {ValidatingFile, MovingFile, ArchivedFile},
+	PublishedFile:  {ArchivedFile},
+	ArchivedFile:   {},
+	FailedFile:     {DetectedFile},
+}
+
+type TransitionError struct {
+	FileId   string
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal status transition of file %q from %s to %s", e.FileId, e.From, e.To)
+}
+
+func statusIndex(status string) int {
+	for i, s := range FileStatuses {
+		if s == status {
+			return i
+		}
+	}
+	if i, ok := legacyStatuses[status]; ok {
+		return i
+	}
+	return -1
+}
+
+// statusNames returns status and the legacy names standing for it
+func statusNames(status string) []string {
+	names := []string{status}
+	for legacy, i := range legacyStatuses {
+		if statusName(i) == status {
+			names = append(names, legacy)
+		}
+	}
+	return names
+}
+
+func canTransition(from, to int) bool {
+	if to == FailedFile {
+		return from != FailedFile && from != ArchivedFile
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Moves file to the status and saves it with all other changes made on file.
+ * Illegal transitions, and files whose status was changed by somebody else
+ * in the meantime, are rejected with *TransitionError. Failures of the store
+ * are returned as *TransientError.
+ */
+func (fm *FileManager) Transition(file *File, status int) error {
+	from := file.Status
+	if status < 0 || status >= len(FileStatuses) || !canTransition(statusIndex(from), status) {
+		return &TransitionError{file.Id, from, statusName(status)}
+	}
+
+	file.Status = FileStatuses[status]
+	file.UpdatedAt = time.Now()
+
+	err := fm.store.UpdateStatus(file, from)
+	if err == ErrStatusChanged {
+		err = &TransitionError{file.Id, from, file.Status}
+	} else if err != nil {
+		err = &TransientError{err}
+	}
+	if err != nil {
+		l.Println("Update file status issue", err)
+		file.Status = from
+		return err
+	}
+
+	l.Printf("File %s %s -> %s", file.FileName, from, file.Status)
+
+	var reason error
+	if status == FailedFile {
+		reason = errors.New(file.Error)
+	}
+	fm.logEvent(file, EventStatus, from, file.Status, "", reason)
+	return nil
+}
+
+func statusName(status int) string {
+	if status < 0 || status >= len(FileStatuses) {
+		return fmt.Sprintf("UNKNOWN(%d)", status)
+	}
+	return FileStatuses[status]
+}
+
+// advance transitions file through statuses in order, stopping at the first error
+func (fm *FileManager) advance(file *File, statuses ...int) error {
+	for _, status := range statuses {
+		if err := fm.Transition(file, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail records reason on file, marks it as failed, quarantines it and notifies admins
+func (fm *FileManager) fail(file *File, pair *WatchPair, reason error) {
+	l.Printf("File %s failed: %v", file.FileName, reason)
+	file.Error = reason.Error()
+	if err := fm.Transition(file, FailedFile); err != nil {
+		l.Println(err)
+		return
+	}
+	fm.quarantine(file, pair, reason)
+	fm.notify(file, pair)
+}
+
+// invalidate is fail for files that break the rules of the pair
+func (fm *FileManager) invalidate(file *File, pair *WatchPair, reason error) error {
+	l.Printf("File %s is invalid: %v", file.FileName, reason)
+	file.Error = reason.Error()
+	if err := fm.Transition(file, InvalidFile); err != nil {
+		return err
+	}
+	fm.quarantine(file, pair, reason)
+	fm.notify(file, pair)
+	return nil
+}
@@ -0,0 +1,176 @@
+package file_manager
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrStatusChanged is returned by FileStore.UpdateStatus when the stored
+// record is no longer in the expected status.
+var ErrStatusChanged = errors.New("file status was changed concurrently")
+
+// ErrDeliveryClaimed is returned by FileStore.ClaimDelivery when another
+// file manager claimed the delivery first.
+var ErrDeliveryClaimed = errors.New("webhook delivery was claimed concurrently")
+
+// ErrStoreLocked is returned when the BoltDB file is held by another
+// process, e.g. mms serve.
+var ErrStoreLocked = errors.New("store is locked by another process")
+
+// FileStore keeps file records and their history
+type FileStore interface {
+	// CreateFile stores a new record and sets its Id
+	CreateFile(file *File) error
+	// Find methods return nil, nil if nothing was found
+	FindFileById(id string) (*File, error)
+	FindFileByName(fileName string) (*File, error)
+	// FindFilesByChecksum returns the records with the sum, oldest first
+	FindFilesByChecksum(algorithm, sum string) ([]*File, error)
+	// FindFilesByPath returns the records of files at the path, oldest first
+	FindFilesByPath(filePath string) ([]*File, error)
+	// UpdateStatus saves file provided the stored record is still in status
+	// from, otherwise ErrStatusChanged is returned
+	UpdateStatus(file *File, from string) error
+	ListFiles(filter *FileFilter) ([]*File, error)
+
+	AddEvent(event *FileEvent) error
+	// FileEvents returns the history of the file, oldest first
+	FileEvents(fileId string) ([]*FileEvent, error)
+
+	// Watch pairs added at runtime, keyed by source
+	SaveWatch(pair *WatchPair) error
+	DeleteWatch(source string) error
+	ListWatches() ([]*WatchPair, error)
+
+	// SaveDelivery creates or replaces an entry of the webhook delivery log
+	// and sets its Id
+	SaveDelivery(delivery *WebhookDelivery) error
+	// ClaimDelivery saves delivery provided the stored entry still has the
+	// claim from, otherwise ErrDeliveryClaimed is returned
+	ClaimDelivery(delivery *WebhookDelivery, from string) error
+	// PendingDeliveries returns the deliveries not yet delivered or given up,
+	// oldest first
+	PendingDeliveries() ([]*WebhookDelivery, error)
+	FileDeliveries(fileId string) ([]*WebhookDelivery, error)
+
+	// SaveJob creates or replaces a job and sets its Id
+	SaveJob(job *Job) error
+	DeleteJob(id string) error
+	// ListJobs returns all jobs, oldest first
+	ListJobs() ([]*Job, error)
+
+	Close() error
+}
+
+// FileFilter selects files in ListFiles, zero values match everything.
+// Files are listed oldest first.
+type FileFilter struct {
+	Status        string
+	Source        string
+	NameContains  string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Offset        int
+	Limit         int
+}
+
+func (f *FileFilter) match(file *File) bool {
+	switch {
+	case f.Status != "" && !hasStatus(file, statusNames(f.Status)):
+		return false
+	case f.Source != "" && file.Source != f.Source:
+		return false
+	case f.NameContains != "" && !strings.Contains(file.FileName, f.NameContains):
+		return false
+	case !f.CreatedAfter.IsZero() && !file.CreatedAt.After(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !file.CreatedAt.Before(f.CreatedBefore):
+		return false
+	}
+	return true
+}
+
+func hasStatus(file *File, statuses []string) bool {
+	for _, status := range statuses {
+		if file.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// page cuts the page selected by Offset and Limit out of files
+func (f *FileFilter) page(files []*File) []*File {
+	if f.Offset >= len(files) {
+		return []*File{}
+	}
+	files = files[f.Offset:]
+
+	if f.Limit > 0 && f.Limit < len(files) {
+		files = files[:f.Limit]
+	}
+	return files
+}
+
+/*
+ * Opens the store selected by the DATABASE_URL environment variable:
+ *   memory://          - in-memory store, records are lost on exit
+ *   bolt:///path/fm.db - embedded BoltDB file, for single host setups
+ *   anything else      - RethinkDB database dbName
+ */
+func OpenStore(dbName string) (FileStore, error) {
+	return openStore(dbName, boltLockWait)
+}
+
+// openStore is OpenStore waiting at most lockWait for a locked BoltDB file
+func openStore(dbName string, lockWait time.Duration) (FileStore, error) {
+	url := os.Getenv("DATABASE_URL")
+	switch {
+	case strings.HasPrefix(url, "memory:"):
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(url, "bolt://"):
+		return newBoltStore(strings.TrimPrefix(url, "bolt://"), lockWait)
+	default:
+		return NewRethinkStore(dbName)
+	}
+}
+
+// Watch pairs are stored in the same YAML form as in the config file,
+// so stores don't need to know about every field of WatchPair
+func encodeWatch(pair *WatchPair) (string, error) {
+	data, err := yaml.Marshal(pair)
+	return string(data), err
+}
+
+func decodeWatch(data string) (*WatchPair, error) {
+	pair := WatchPair{}
+	if err := yaml.Unmarshal([]byte(data), &pair); err != nil {
+		return nil, err
+	}
+	return &pair, nil
+}
+
+type deliveriesByCreation []*WebhookDelivery
+
+func (d deliveriesByCreation) Len() int      { return len(d) }
+func (d deliveriesByCreation) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d deliveriesByCreation) Less(i, j int) bool {
+	if d[i].CreatedAt.Equal(d[j].CreatedAt) {
+		return d[i].Id < d[j].Id
+	}
+	return d[i].CreatedAt.Before(d[j].CreatedAt)
+}
+
+type jobsByCreation []*Job
+
+func (j jobsByCreation) Len() int      { return len(j) }
+func (j jobsByCreation) Swap(i, k int) { j[i], j[k] = j[k], j[i] }
+func (j jobsByCreation) Less(i, k int) bool {
+	if j[i].CreatedAt.Equal(j[k].CreatedAt) {
+		return j[i].Id < j[k].Id
+	}
+	return j[i].CreatedAt.Before(j[k].CreatedAt)
+}
@@ -0,0 +1,236 @@
+package file_manager_test
+
+import (
+	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
+	"github.com/Bnei-Baruch/mms-file-manager/media"
+
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"time"
+)
+
+const boltFile = "tmp/store_test.db"
+
+var _ = Describe("Stores", func() {
+	stores := map[string]func() fm.FileStore{
+		"memory": fm.NewMemoryStore,
+		"bolt": func() fm.FileStore {
+			os.Remove(boltFile)
+			store, err := fm.NewBoltStore(boltFile)
+			if err != nil {
+				Fail(fmt.Sprintf("Unable to open bolt store: %v", err))
+			}
+			return store
+		},
+	}
+
+	for name, open := range stores {
+		name, open := name, open
+		Context("Using "+name+" store", func() {
+			storeSpecs(open)
+		})
+	}
+
+	It("must keep records of the bolt store after reopening", func() {
+		store := stores["bolt"]()
+		file := &fm.File{FileName: "a.mp3", Status: "DETECTED"}
+		Ω(store.CreateFile(file)).Should(Succeed())
+		Ω(store.AddEvent(&fm.FileEvent{FileId: file.Id, Action: fm.EventDetected})).Should(Succeed())
+		store.Close()
+
+		store, err := fm.NewBoltStore(boltFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer store.Close()
+
+		found, err := store.FindFileById(file.Id)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(found.FileName).Should(Equal("a.mp3"))
+
+		events, err := store.FileEvents(file.Id)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(HaveLen(1))
+	})
+})
+
+func storeSpecs(open func() fm.FileStore) {
+	var store fm.FileStore
+
+	BeforeEach(func() {
+		store = open()
+	})
+
+	AfterEach(func() {
+		store.Close()
+	})
+
+	createFile := func(name, status string, createdAt time.Time) *fm.File {
+		file := &fm.File{FileName: name, Status: status, Sha1: name + "-sum", CreatedAt: createdAt}
+		Ω(store.CreateFile(file)).Should(Succeed())
+		Ω(file.Id).ShouldNot(BeEmpty())
+		return file
+	}
+
+	It("must find files by id, name and checksum", func() {
+		file := createFile("a.mp3", "DETECTED", time.Now())
+
+		found, err := store.FindFileById(file.Id)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(found.FileName).Should(Equal("a.mp3"))
+
+		found, err = store.FindFileByName("a.mp3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(found.Id).Should(Equal(file.Id))
+
+		files, err := store.FindFilesByChecksum(fm.SHA1, "a.mp3-sum")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+
+		found, err = store.FindFileByName("b.mp3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(found).Should(BeNil())
+	})
+
+	It("must not share media of stored records", func() {
+		file := &fm.File{FileName: "a.mp3", Status: "VALID", Media: &media.Info{Duration: 60, Tags: map[string]string{"title": "Lesson"}}}
+		Ω(store.CreateFile(file)).Should(Succeed())
+		file.Media.Tags["title"] = "changed"
+
+		found, _ := store.FindFileById(file.Id)
+		Ω(found.Media.Tags["title"]).Should(Equal("Lesson"))
+		found.Media.Duration = 0
+
+		found, _ = store.FindFileById(file.Id)
+		Ω(found.Media.Duration).Should(Equal(60.0))
+	})
+
+	It("must find files by path", func() {
+		file := &fm.File{FileName: "a.mp3", FilePath: "source/a.mp3", Status: "DETECTED"}
+		Ω(store.CreateFile(file)).Should(Succeed())
+
+		file.FilePath = "target/a.mp3"
+		Ω(store.UpdateStatus(file, "DETECTED")).Should(Succeed())
+
+		files, err := store.FindFilesByPath("source/a.mp3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(BeEmpty())
+
+		files, err = store.FindFilesByPath("target/a.mp3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+		Ω(files[0].Id).Should(Equal(file.Id))
+	})
+
+	It("must update only files in the expected status", func() {
+		file := createFile("a.mp3", "DETECTED", time.Now())
+
+		file.Status = "STABLE"
+		Ω(store.UpdateStatus(file, "DETECTED")).Should(Succeed())
+
+		file.Status = "MOVING"
+		Ω(store.UpdateStatus(file, "DETECTED")).Should(Equal(fm.ErrStatusChanged))
+
+		found, _ := store.FindFileById(file.Id)
+		Ω(found.Status).Should(Equal("STABLE"))
+	})
+
+	It("must replace the whole record", func() {
+		file := createFile("a.mp3", "FAILED", time.Now())
+		file.Error = "corrupted"
+		Ω(store.UpdateStatus(file, "FAILED")).Should(Succeed())
+
+		file.Error = ""
+		Ω(store.UpdateStatus(file, "FAILED")).Should(Succeed())
+		// nothing changed
+		Ω(store.UpdateStatus(file, "FAILED")).Should(Succeed())
+
+		found, _ := store.FindFileById(file.Id)
+		Ω(found.Error).Should(BeEmpty())
+	})
+
+	It("must filter and page listed files", func() {
+		now := time.Now()
+		createFile("lesson-1.mp3", "VALID", now.Add(-3*time.Hour))
+		createFile("lesson-2.mp3", "INVALID", now.Add(-2*time.Hour))
+		createFile("lesson-3.mp3", "VALID", now.Add(-time.Hour))
+		createFile("song.mp3", "VALID", now)
+
+		files, err := store.ListFiles(&fm.FileFilter{Status: "VALID", NameContains: "lesson"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+		Ω(files[0].FileName).Should(Equal("lesson-1.mp3"))
+
+		files, _ = store.ListFiles(&fm.FileFilter{CreatedAfter: now.Add(-150 * time.Minute), Offset: 1, Limit: 1})
+		Ω(files).Should(HaveLen(1))
+		Ω(files[0].FileName).Should(Equal("lesson-3.mp3"))
+	})
+
+	It("must keep the history in order", func() {
+		file := createFile("a.mp3", "DETECTED", time.Now())
+		for _, action := range []string{fm.EventDetected, fm.EventChecksum, fm.EventMoved} {
+			Ω(store.AddEvent(&fm.FileEvent{FileId: file.Id, Action: action})).Should(Succeed())
+		}
+
+		events, err := store.FileEvents(file.Id)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(HaveLen(3))
+		Ω(events[2].Action).Should(Equal(fm.EventMoved))
+	})
+
+	It("must keep the webhook delivery log", func() {
+		now := time.Now()
+		first := &fm.WebhookDelivery{FileId: "a", Status: fm.DeliveryPending, CreatedAt: now.Add(-time.Minute)}
+		second := &fm.WebhookDelivery{FileId: "a", Status: fm.DeliveryPending, CreatedAt: now}
+		for _, d := range []*fm.WebhookDelivery{second, first} {
+			Ω(store.SaveDelivery(d)).Should(Succeed())
+			Ω(d.Id).ShouldNot(BeEmpty())
+		}
+
+		first.Status = fm.DeliveryDelivered
+		Ω(store.SaveDelivery(first)).Should(Succeed())
+
+		pending, err := store.PendingDeliveries()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pending).Should(HaveLen(1))
+		Ω(pending[0].Id).Should(Equal(second.Id))
+
+		deliveries, err := store.FileDeliveries("a")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(deliveries).Should(HaveLen(2))
+		Ω(deliveries[0].Status).Should(Equal(fm.DeliveryDelivered))
+	})
+
+	It("must claim deliveries only once", func() {
+		delivery := &fm.WebhookDelivery{FileId: "a", Status: fm.DeliveryPending, CreatedAt: time.Now()}
+		Ω(store.SaveDelivery(delivery)).Should(Succeed())
+
+		first, second := *delivery, *delivery
+		first.Claim, second.Claim = "first", "second"
+		Ω(store.ClaimDelivery(&first, "")).Should(Succeed())
+		Ω(store.ClaimDelivery(&second, "")).Should(Equal(fm.ErrDeliveryClaimed))
+
+		deliveries, _ := store.FileDeliveries("a")
+		Ω(deliveries[0].Claim).Should(Equal("first"))
+	})
+
+	It("must keep jobs until deleted", func() {
+		now := time.Now()
+		second := &fm.Job{Path: "b.mp3", Status: fm.JobQueued, CreatedAt: now}
+		first := &fm.Job{Path: "a.mp3", Status: fm.JobQueued, CreatedAt: now.Add(-time.Minute)}
+		for _, job := range []*fm.Job{second, first} {
+			Ω(store.SaveJob(job)).Should(Succeed())
+			Ω(job.Id).ShouldNot(BeEmpty())
+		}
+
+		first.Status, first.FileId = fm.JobRunning, "a"
+		Ω(store.SaveJob(first)).Should(Succeed())
+		Ω(store.DeleteJob(second.Id)).Should(Succeed())
+
+		jobs, err := store.ListJobs()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(jobs).Should(HaveLen(1))
+		Ω(jobs[0].Status).Should(Equal(fm.JobRunning))
+		Ω(jobs[0].FileId).Should(Equal("a"))
+	})
+}
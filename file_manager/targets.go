@@ -0,0 +1,276 @@
+package file_manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How files get to the targets of a pair
+const (
+	// Move the file to the target, other targets get copies (default)
+	ModeMove = "move"
+	// Copy the file to every target, the source is kept
+	ModeCopy = "copy"
+	// Hard link the file into every target, the source is kept. Targets on
+	// another filesystem get copies.
+	ModeHardlink = "hardlink"
+)
+
+// PairTarget is a target of a watch pair besides WatchPair.Target, e.g.
+// a transcoder inbox or an offsite backup
+type PairTarget struct {
+	Path string `yaml:"path" json:"path"`
+	// Failures of optional targets are recorded on the file, but don't hold
+	// back the import
+	Optional bool `yaml:"optional" json:"optional"`
+}
+
+// TargetDelivery records how the file got to a target of its pair
+type TargetDelivery struct {
+	// target directory
+	Target string `gorethink:"target" json:"target"`
+	// where the file is in the target
+	Path     string    `gorethink:"path,omitempty" json:"path,omitempty"`
+	Mode     string    `gorethink:"mode" json:"mode"`
+	Required bool      `gorethink:"required" json:"required"`
+	Status   string    `gorethink:"status" json:"status"`
+	Error    string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	Time     time.Time `gorethink:"time" json:"time"`
+
+	// Policy applied because the name was taken, see ConflictRename
+	Conflict string `gorethink:"conflict,omitempty" json:"conflict,omitempty"`
+	// Where the file that had the name went, for ConflictVersion
+	Version string `gorethink:"version,omitempty" json:"version,omitempty"`
+}
+
+func (pair *WatchPair) validateTargets() error {
+	switch pair.Mode {
+	case "", ModeMove, ModeCopy, ModeHardlink:
+	default:
+		return fmt.Errorf("unknown mode %q for %q", pair.Mode, pair.Source)
+	}
+
+	seen := map[string]bool{filepath.Clean(pair.Target): true}
+	for _, t := range pair.Targets {
+		if t.Path == "" {
+			return fmt.Errorf("%q key is missing in a target of %q", "path", pair.Source)
+		}
+		if isWithin(pair.Source, t.Path) {
+			return fmt.Errorf("target %q of %q must not be inside the source", t.Path, pair.Source)
+		}
+		if seen[filepath.Clean(t.Path)] {
+			return fmt.Errorf("target %q of %q is listed twice", t.Path, pair.Source)
+		}
+		seen[filepath.Clean(t.Path)] = true
+	}
+	return nil
+}
+
+func (pair *WatchPair) mode() string {
+	if pair.Mode == "" {
+		return ModeMove
+	}
+	return pair.Mode
+}
+
+// targetDirs returns the primary and additional targets of the pair
+func (pair *WatchPair) targetDirs() []string {
+	dirs := []string{pair.Target}
+	for _, t := range pair.Targets {
+		dirs = append(dirs, t.Path)
+	}
+	return dirs
+}
+
+// delivery returns the delivery of the file to target, nil if there's none
+func (file *File) delivery(target string) *TargetDelivery {
+	for i := range file.Deliveries {
+		if file.Deliveries[i].Target == target {
+			return &file.Deliveries[i]
+		}
+	}
+	return nil
+}
+
+// delivered records the outcome of delivery d, replacing an earlier one
+// to the same target
+func (file *File) delivered(d TargetDelivery, err error) {
+	d.Time, d.Status = time.Now(), DeliveryDelivered
+	if err != nil {
+		d.Status, d.Error = DeliveryFailed, err.Error()
+	}
+
+	if earlier := file.delivery(d.Target); earlier != nil {
+		*earlier = d
+	} else {
+		file.Deliveries = append(file.Deliveries, d)
+	}
+}
+
+/*
+ * Delivers the file to the additional targets of the pair, then to its
+ * primary target. The file is only moved, which removes the source, once
+ * every required target has its copy. Targets delivered by an earlier
+ * attempt are skipped.
+ */
+func (fm *FileManager) deliverFile(file *File, pair *WatchPair) error {
+	failed := []string{}
+	var conflict error
+	for _, t := range pair.Targets {
+		if d := file.delivery(t.Path); d != nil && d.Status == DeliveryDelivered {
+			continue
+		}
+
+		mode := pair.mode()
+		if mode == ModeMove {
+			mode = ModeCopy
+		}
+		if _, err := fm.placeFile(file, pair, t.Path, mode, !t.Optional); err != nil {
+			l.Printf("Unable to deliver %q to %q: %v", file.FilePath, t.Path, err)
+			if !t.Optional {
+				failed = append(failed, t.Path)
+			}
+			if _, ok := err.(*ConflictError); ok && !t.Optional && conflict == nil {
+				conflict = err
+			}
+		}
+	}
+
+	if len(pair.Targets) > 0 {
+		fm.saveDeliveries(file)
+	}
+	if conflict != nil {
+		return conflict
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to deliver %q to %s", file.FilePath, strings.Join(failed, ", "))
+	}
+	return fm.moveToTarget(file, pair)
+}
+
+// placeFile puts the file into the target directory following the pair's
+// layout, records the delivery on the file and returns where the file is
+func (fm *FileManager) placeFile(file *File, pair *WatchPair, dir, mode string, required bool) (target string, err error) {
+	d := TargetDelivery{Target: dir, Mode: mode, Required: required}
+	defer func() {
+		d.Path = target
+		file.delivered(d, err)
+	}()
+
+	p := *pair
+	p.Target = dir
+	path, err := p.targetPath(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to prepare target of %q: %v", file.FilePath, err)
+	}
+	target, reserved, err := fm.claimTarget(file, pair, path, &d)
+	if err != nil {
+		return "", err
+	}
+	if file.job != nil && dir == pair.Target {
+		file.job.Target = target
+		fm.saveJob(file.job)
+	}
+
+	switch mode {
+	case ModeCopy:
+		err = fm.copyFile(file.FilePath, target)
+	case ModeHardlink:
+		if reserved || d.Conflict == ConflictOverwrite {
+			// in the way of the link
+			os.Remove(target)
+		}
+		err = fm.linkFile(file.FilePath, target)
+	default:
+		err = fm.moveFile(file, file.FilePath, target)
+	}
+
+	details := mode
+	if d.Conflict != "" {
+		details += " " + d.Conflict
+	}
+	fm.logMove(file, file.FilePath, target, details, err)
+	if err != nil {
+		if reserved {
+			os.Remove(target)
+		}
+		return "", fmt.Errorf("unable to %s %q: %v", mode, file.FilePath, err)
+	}
+	return target, nil
+}
+
+// linkFile hard links from to to, copying it if they are on
+// different filesystems
+func (fm *FileManager) linkFile(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+	l.Printf("%q and %q are on different filesystems, copying", from, to)
+	return fm.copyFile(from, to)
+}
+
+// moveToTarget delivers the file to the pair's primary target and records
+// its new path. Only files in the source are copied or linked, files taken
+// from elsewhere, e.g. released from quarantine, are moved.
+func (fm *FileManager) moveToTarget(file *File, pair *WatchPair) error {
+	mode := pair.mode()
+	if !isWithin(pair.Source, file.FilePath) {
+		mode = ModeMove
+	}
+
+	target, err := fm.placeFile(file, pair, pair.Target, mode, true)
+	if err != nil {
+		return err
+	}
+	file.FilePath = target
+	return nil
+}
+
+// findDelivered returns the record of the file if it was taken from the
+// same path already, nil otherwise: delivered to the pair's target, or
+// failed and left in the source. Files kept by the copy and hardlink modes
+// and failed ones stay in the source, so they are offered again on every
+// scan.
+func (fm *FileManager) findDelivered(file *File, pair *WatchPair) (*File, error) {
+	copies, err := fm.findSameContent(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range copies {
+		if f.SourcePath != file.SourcePath || f.Source != pair.Source {
+			continue
+		}
+		if f.FilePath == file.SourcePath && f.Status == FileStatuses[FailedFile] {
+			return f, nil
+		}
+		if pair.mode() == ModeMove {
+			continue
+		}
+		if d := f.delivery(pair.Target); d != nil && d.Status == DeliveryDelivered {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// makeTargets creates the target directories of the pair
+func (pair *WatchPair) makeTargets() error {
+	for _, dir := range pair.targetDirs() {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveDeliveries saves the deliveries made so far, so another attempt
+// doesn't repeat them
+func (fm *FileManager) saveDeliveries(file *File) {
+	if err := fm.store.UpdateStatus(file, file.Status); err != nil {
+		l.Printf("Unable to save deliveries of %s: %v", file.FileName, err)
+	}
+}
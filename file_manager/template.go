@@ -0,0 +1,102 @@
+package file_manager
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Bnei-Baruch/mms-file-manager/media"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Fields available to target templates besides those of the file record,
+// e.g. "{{.Year}}/{{.Month}}/{{.Lang}}/{{.Name}}". Media is read before the
+// file is delivered, it's nil for files of other formats.
+type targetFields struct {
+	*File
+	Name    string // file name
+	Ext     string // extension without the dot
+	Dir     string // directory relative to the source, empty at its top
+	ModTime time.Time
+	// of the date in the name, or of the modification time, zero padded
+	Year, Month, Day string
+	// language of the name, e.g. heb
+	Lang string
+}
+
+func parseTargetTemplate(text string) (*template.Template, error) {
+	return template.New("target").Parse(text)
+}
+
+// validateTemplate also executes the template on a sample file, because
+// unknown fields are only reported then
+func validateTemplate(text, source string) error {
+	if text == "" {
+		return nil
+	}
+
+	t, err := parseTargetTemplate(text)
+	if err == nil {
+		err = t.Execute(ioutil.Discard, &targetFields{File: &File{Media: &media.Info{}}})
+	}
+	if err != nil {
+		return fmt.Errorf("bad target template for %q: %v", source, err)
+	}
+	return nil
+}
+
+// expandTemplate returns the path of file relative to the pair's target
+func (pair *WatchPair) expandTemplate(file *File) (string, error) {
+	t, err := parseTargetTemplate(pair.TargetTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(file.FilePath)
+	if err != nil {
+		return "", err
+	}
+
+	if file.Media == nil && media.Format(file.FilePath) != "" {
+		// validation reads it again from the target
+		if file.Media, err = media.Probe(file.FilePath); err != nil {
+			l.Printf("Unable to read metadata of %s: %v", file.FileName, err)
+		}
+	}
+
+	date := file.Date
+	if date.IsZero() {
+		date = info.ModTime()
+	}
+
+	fields := &targetFields{
+		File:    file,
+		Name:    filepath.Base(file.FilePath),
+		Ext:     strings.TrimPrefix(filepath.Ext(file.FilePath), "."),
+		ModTime: info.ModTime(),
+		Year:    date.Format("2006"),
+		Month:   date.Format("01"),
+		Day:     date.Format("02"),
+		Lang:    file.Language,
+	}
+	if isWithin(pair.Source, file.FilePath) {
+		if dir, _ := filepath.Rel(pair.Source, filepath.Dir(file.FilePath)); dir != "." {
+			fields.Dir = dir
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+
+	// the result must stay inside the target
+	rel := filepath.Clean(buf.String())
+	if rel == "." || filepath.IsAbs(rel) || !isWithin(".", rel) {
+		return "", fmt.Errorf("target template of %q gives bad path %q for %q", pair.Source, buf.String(), file.FilePath)
+	}
+	return rel, nil
+}
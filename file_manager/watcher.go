@@ -0,0 +1,280 @@
+package file_manager
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/fsnotify.v1"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	NotifyWatcher = "notify"
+	PollWatcher   = "poll"
+
+	defaultPollInterval = 2 * time.Second
+)
+
+var errStopped = errors.New("watch stopped")
+
+type dirWatcher struct {
+	fm      *FileManager
+	pair    *WatchPair
+	settler *settler
+	// closed by Unwatch or Destroy, running tracks goroutines to wait for
+	stop    chan bool
+	running sync.WaitGroup
+}
+
+func newDirWatcher(fm *FileManager, pair *WatchPair) *dirWatcher {
+	return &dirWatcher{
+		fm:   fm,
+		pair: pair,
+		stop: make(chan bool),
+	}
+}
+
+// start runs the watcher in the background
+func (w *dirWatcher) start() {
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		w.watch()
+	}()
+}
+
+// halt stops the watcher and waits until it doesn't send any more files
+func (w *dirWatcher) halt() {
+	close(w.stop)
+	w.running.Wait()
+}
+
+func (pair *WatchPair) validate() error {
+	if pair.Source == "" {
+		return fmt.Errorf("%q key is missing in watch pair", "source")
+	}
+	if pair.Target == "" {
+		return fmt.Errorf("%q key is missing in watch pair %q", "target", pair.Source)
+	}
+
+	switch pair.Watcher {
+	case "", NotifyWatcher, PollWatcher:
+	default:
+		return fmt.Errorf("unknown watcher %q for %q", pair.Watcher, pair.Source)
+	}
+
+	if pair.PollInterval < 0 || pair.RescanInterval < 0 {
+		return fmt.Errorf("intervals of %q must not be negative", pair.Source)
+	}
+	if err := validateChecksums(pair.Checksums, pair.Source); err != nil {
+		return err
+	}
+	if err := pair.Duplicates.validate(pair.Source); err != nil {
+		return err
+	}
+	if err := validateLayout(pair.Layout, pair.Source); err != nil {
+		return err
+	}
+	if err := validateTemplate(pair.TargetTemplate, pair.Source); err != nil {
+		return err
+	}
+	if err := pair.Media.validate(pair.Source); err != nil {
+		return err
+	}
+	if err := validateAddresses(pair.Notify); err != nil {
+		return err
+	}
+	if pair.Workers < 0 {
+		return fmt.Errorf("workers of %q must not be negative", pair.Source)
+	}
+	if err := pair.Retry.validate(pair.Source); err != nil {
+		return err
+	}
+	if err := pair.validateTargets(); err != nil {
+		return err
+	}
+	if err := validateConflict(pair.Conflict, pair.Source); err != nil {
+		return err
+	}
+	if pair.Quarantine != "" && isWithin(pair.Source, pair.Quarantine) {
+		return fmt.Errorf("quarantine of %q must not be inside the source", pair.Source)
+	}
+	return pair.Settle.validate(pair.Source)
+}
+
+func (pair *WatchPair) checksumAlgorithms() []string {
+	if len(pair.Checksums) == 0 {
+		return defaultChecksums
+	}
+	return pair.Checksums
+}
+
+/*
+ * Starts watching a pair. Regardless of the watcher type the source directory
+ * is walked once so files dropped while we were down are picked up too.
+ * If the notify watcher can't be started we fall back to polling.
+ */
+func (w *dirWatcher) watch() {
+	if w.pair.Settle.enabled() {
+		w.settler = newSettler(w)
+		w.running.Add(1)
+		go func() {
+			defer w.running.Done()
+			w.settler.run()
+		}()
+	}
+
+	if w.pair.Watcher != PollWatcher {
+		err := w.notifyWatch()
+		if err == nil {
+			return
+		}
+		l.Printf("Unable to start notify watcher for %q, falling back to polling: %v", w.pair.Source, err)
+	}
+	w.pollWatch()
+}
+
+func (w *dirWatcher) pollWatch() {
+	interval := w.pair.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !w.scan(w.pair.Source) {
+			l.Println("Exiting watch", w.pair.Source)
+			return
+		}
+
+		select {
+		case <-w.stop:
+			l.Println("Exiting watch", w.pair.Source)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyWatch returns an error if the watcher can't be set up,
+// otherwise it watches until stopped
+func (w *dirWatcher) notifyWatch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err = addDirs(watcher, w.pair.Source); err != nil {
+		return err
+	}
+
+	// rescan is nil unless configured, so the case below never fires
+	var rescan <-chan time.Time
+	if w.pair.RescanInterval > 0 {
+		ticker := time.NewTicker(w.pair.RescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+
+	if !w.scan(w.pair.Source) {
+		l.Println("Exiting watch", w.pair.Source)
+		return nil
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			l.Println("Exiting watch", w.pair.Source)
+			return nil
+		case <-rescan:
+			if !w.scan(w.pair.Source) {
+				l.Println("Exiting watch", w.pair.Source)
+				return nil
+			}
+		case err := <-watcher.Errors:
+			l.Printf("Watcher error on %q: %v", w.pair.Source, err)
+		case event := <-watcher.Events:
+			if !w.handleEvent(watcher, event) {
+				l.Println("Exiting watch", w.pair.Source)
+				return nil
+			}
+		}
+	}
+}
+
+func (w *dirWatcher) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return true
+	}
+
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		return true
+	}
+
+	if info.IsDir() {
+		// files may be created before the new directory is added to the
+		// watcher, so scan it right after adding
+		if err := addDirs(watcher, event.Name); err != nil {
+			l.Printf("Unable to watch %q: %v", event.Name, err)
+		}
+		return w.scan(event.Name)
+	}
+
+	if info.Mode().IsRegular() {
+		return w.offer(event.Name)
+	}
+	return true
+}
+
+func addDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// scan walks dir and offers every regular file to the state monitor.
+// Returns false if the watch was stopped in the meantime.
+func (w *dirWatcher) scan(dir string) bool {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if info != nil && info.Mode().IsRegular() && !w.offer(path) {
+			return errStopped
+		}
+
+		return nil
+	})
+	return err != errStopped
+}
+
+// offer drops ignored files and hands the rest to the settler, or straight
+// to the state monitor when no settle policy is configured.
+func (w *dirWatcher) offer(path string) bool {
+	if w.pair.Settle.ignored(path) {
+		return true
+	}
+
+	if w.settler != nil {
+		return w.settler.offer(path)
+	}
+	return w.send(path)
+}
+
+func (w *dirWatcher) send(path string) bool {
+	select {
+	case w.fm.updates <- updateMsg{file: path, pair: w.pair}:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
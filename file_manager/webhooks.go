@@ -0,0 +1,449 @@
+package file_manager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Events sent to webhooks
+const (
+	HookImported    = "imported"
+	HookValidated   = "validated"
+	HookInvalidated = "invalidated"
+	HookFailed      = "failed"
+	HookDeleted     = "deleted"
+)
+
+// Statuses of webhook deliveries, and of deliveries to targets
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	defaultHookAttempts = 10
+	defaultHookBackoff  = 10 * time.Second
+	maxHookBackoff      = time.Hour
+	hookTimeout         = 30 * time.Second
+	// a claimed delivery isn't taken by other file managers for this long,
+	// see claim
+	hookLease = 2 * hookTimeout
+	// the store is checked this often for deliveries due,
+	// e.g. ones left over by a previous run
+	hookPollInterval = time.Second
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the body, keyed by the secret
+const SignatureHeader = "X-MMS-Signature"
+
+// A URL notified of file events with a POST of a HookPayload
+type Webhook struct {
+	URL string `yaml:"url" json:"url"`
+	// Signs the payload if set, see SignatureHeader
+	Secret string `yaml:"secret" json:"-"`
+	// Events sent to the URL, all if empty
+	Events []string `yaml:"events" json:"events"`
+
+	// Failed deliveries are retried with a backoff that doubles on every
+	// attempt. Default to 10 attempts and 10 seconds.
+	MaxAttempts int           `yaml:"max_attempts" json:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff" json:"backoff"`
+}
+
+// Body of webhook requests
+type HookPayload struct {
+	Event   string    `json:"event"`
+	Details string    `json:"details,omitempty"`
+	Time    time.Time `json:"time"`
+	File    *File     `json:"file"`
+}
+
+// WebhookDelivery is an entry of the delivery log, kept until delivered
+// or given up so that nothing is lost across restarts
+type WebhookDelivery struct {
+	Id          string    `gorethink:"id,omitempty" json:"id,omitempty"`
+	FileId      string    `gorethink:"file_id" json:"file_id"`
+	Event       string    `gorethink:"event" json:"event"`
+	URL         string    `gorethink:"url" json:"url"`
+	Payload     string    `gorethink:"payload" json:"payload"`
+	Status      string    `gorethink:"status" json:"status"`
+	Attempts    int       `gorethink:"attempts" json:"attempts"`
+	StatusCode  int       `gorethink:"status_code,omitempty" json:"status_code,omitempty"`
+	Error       string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	NextAttempt time.Time `gorethink:"next_attempt" json:"next_attempt"`
+	CreatedAt   time.Time `gorethink:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `gorethink:"updated_at" json:"updated_at"`
+
+	// Changed by every claim, see ClaimDelivery
+	Claim string `gorethink:"claim,omitempty" json:"claim,omitempty"`
+}
+
+func (hook *Webhook) validate() error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad webhook url %q", hook.URL)
+	}
+	for _, event := range hook.Events {
+		switch event {
+		case HookImported, HookValidated, HookInvalidated, HookFailed, HookDeleted:
+		default:
+			return fmt.Errorf("unknown event %q of webhook %q", event, hook.URL)
+		}
+	}
+	if hook.MaxAttempts < 0 || hook.Backoff < 0 {
+		return fmt.Errorf("retries of webhook %q must not be negative", hook.URL)
+	}
+	return nil
+}
+
+func (hook *Webhook) wants(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (hook *Webhook) backoff(attempts int) time.Duration {
+	backoff := hook.Backoff
+	if backoff == 0 {
+		backoff = defaultHookBackoff
+	}
+	for i := 1; i < attempts && backoff < maxHookBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxHookBackoff {
+		backoff = maxHookBackoff
+	}
+	return backoff
+}
+
+func (hook *Webhook) maxAttempts() int {
+	if hook.MaxAttempts == 0 {
+		return defaultHookAttempts
+	}
+	return hook.MaxAttempts
+}
+
+// Sign returns the signature of body, see SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hookEvent returns the webhook event of a file event, if any
+func hookEvent(action, to string) string {
+	switch action {
+	case EventDeleted:
+		return HookDeleted
+	case EventStatus:
+		switch to {
+		case FileStatuses[MovedFile]:
+			return HookImported
+		case FileStatuses[ValidFile]:
+			return HookValidated
+		case FileStatuses[InvalidFile]:
+			return HookInvalidated
+		case FileStatuses[FailedFile]:
+			return HookFailed
+		}
+	}
+	return ""
+}
+
+// dispatcher sends the deliveries of the log, one sender per URL so a
+// webhook that is down doesn't hold back the others
+type dispatcher struct {
+	sync.Mutex
+	fm     *FileManager
+	hooks  []Webhook
+	client *http.Client
+	kick   chan bool
+	stop   chan bool
+	done   sync.WaitGroup
+	// URLs with a sender running
+	busy map[string]bool
+}
+
+func newDispatcher(fm *FileManager) *dispatcher {
+	return &dispatcher{
+		fm:     fm,
+		client: &http.Client{Timeout: hookTimeout},
+		kick:   make(chan bool, 1),
+		stop:   make(chan bool),
+		busy:   make(map[string]bool),
+	}
+}
+
+/*
+ * Sets the webhooks notified of file events. Pending deliveries to URLs
+ * no file manager on the store has configured are given up once they are
+ * overdue by an hour.
+ */
+func (fm *FileManager) SetWebhooks(hooks []Webhook) error {
+	for i := range hooks {
+		if err := hooks[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	d := fm.dispatcher
+	d.Lock()
+	d.hooks = hooks
+	d.Unlock()
+	d.wake()
+	return nil
+}
+
+// FileDeliveries returns the webhook deliveries of the file, oldest first
+func (fm *FileManager) FileDeliveries(fileId string) ([]*WebhookDelivery, error) {
+	deliveries, err := fm.store.FileDeliveries(fileId)
+	if err != nil {
+		l.Println(err)
+	}
+	return deliveries, err
+}
+
+// enqueue logs a delivery of the event to every webhook that wants it
+func (d *dispatcher) enqueue(file *File, event, details string) {
+	d.Lock()
+	hooks := d.hooks
+	d.Unlock()
+
+	var body []byte
+	for _, hook := range hooks {
+		if !hook.wants(event) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			body, err = json.Marshal(&HookPayload{Event: event, Details: details, Time: time.Now(), File: file})
+			if err != nil {
+				l.Printf("Unable to encode %s event of %s: %v", event, file.FileName, err)
+				return
+			}
+		}
+
+		now := time.Now()
+		delivery := &WebhookDelivery{
+			FileId:      file.Id,
+			Event:       event,
+			URL:         hook.URL,
+			Payload:     string(body),
+			Status:      DeliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := d.fm.store.SaveDelivery(delivery); err != nil {
+			l.Printf("Unable to log %s event of %s for %s: %v", event, file.FileName, hook.URL, err)
+		}
+	}
+
+	if body != nil {
+		d.wake()
+	}
+}
+
+func (d *dispatcher) wake() {
+	select {
+	case d.kick <- true:
+	default:
+	}
+}
+
+// start sends deliveries until halt, ones due right away first
+func (d *dispatcher) start() {
+	d.done.Add(1)
+	go func() {
+		defer d.done.Done()
+
+		timer := time.NewTimer(0)
+		defer func() { timer.Stop() }()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-d.kick:
+			case <-timer.C:
+			}
+
+			timer.Stop()
+			timer = time.NewTimer(d.deliverDue())
+		}
+	}()
+}
+
+func (d *dispatcher) halt() {
+	close(d.stop)
+	d.done.Wait()
+}
+
+/*
+ * Hands the pending deliveries that are due to the senders of their URLs
+ * and returns how long to wait for the next one. Deliveries to URLs not
+ * configured here are left to the other file managers on the store.
+ */
+func (d *dispatcher) deliverDue() time.Duration {
+	d.Lock()
+	hooks := make(map[string]Webhook)
+	for _, hook := range d.hooks {
+		hooks[hook.URL] = hook
+	}
+	d.Unlock()
+
+	if len(hooks) == 0 {
+		// nothing is sent until webhooks are set
+		return hookPollInterval
+	}
+
+	deliveries, err := d.fm.store.PendingDeliveries()
+	if err != nil {
+		l.Println("Unable to read webhook deliveries", err)
+		return hookPollInterval
+	}
+
+	wait := hookPollInterval
+	due := make(map[string][]*WebhookDelivery)
+	for _, delivery := range deliveries {
+		if until := delivery.NextAttempt.Sub(time.Now()); until > 0 {
+			if until < wait {
+				wait = until
+			}
+			continue
+		}
+
+		if _, ok := hooks[delivery.URL]; ok {
+			due[delivery.URL] = append(due[delivery.URL], delivery)
+		} else if time.Since(delivery.NextAttempt) > maxHookBackoff && d.claim(delivery) {
+			// nobody took it up
+			delivery.Status = DeliveryFailed
+			delivery.Error = "webhook is not configured"
+			d.save(delivery)
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for url, deliveries := range due {
+		if d.busy[url] {
+			// picked up by the next round
+			continue
+		}
+		d.busy[url] = true
+		d.done.Add(1)
+		go d.send(hooks[url], deliveries)
+	}
+	return wait
+}
+
+// send posts the deliveries to the webhook one after the other
+func (d *dispatcher) send(hook Webhook, deliveries []*WebhookDelivery) {
+	defer d.done.Done()
+	defer func() {
+		d.Lock()
+		delete(d.busy, hook.URL)
+		d.Unlock()
+		d.wake()
+	}()
+
+	for _, delivery := range deliveries {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		if d.claim(delivery) {
+			d.deliver(&hook, delivery)
+			d.save(delivery)
+		}
+	}
+}
+
+// claim takes the delivery for hookLease, so file managers sharing the
+// store don't post it twice. A claim left by a crash runs out.
+func (d *dispatcher) claim(delivery *WebhookDelivery) bool {
+	from := delivery.Claim
+	delivery.Claim = newId()
+	delivery.NextAttempt = time.Now().Add(hookLease)
+	delivery.UpdatedAt = time.Now()
+
+	err := d.fm.store.ClaimDelivery(delivery, from)
+	if err != nil && err != ErrDeliveryClaimed {
+		l.Printf("Unable to claim delivery %s: %v", delivery.Id, err)
+	}
+	return err == nil
+}
+
+func (d *dispatcher) save(delivery *WebhookDelivery) {
+	delivery.UpdatedAt = time.Now()
+	if err := d.fm.store.SaveDelivery(delivery); err != nil {
+		l.Printf("Unable to save delivery %s: %v", delivery.Id, err)
+	}
+}
+
+// deliver makes an attempt to post the delivery and schedules the next one
+func (d *dispatcher) deliver(hook *Webhook, delivery *WebhookDelivery) {
+	delivery.Attempts++
+	delivery.StatusCode, delivery.Error = 0, ""
+
+	err := d.post(hook, delivery)
+	if err == nil {
+		delivery.Status = DeliveryDelivered
+		return
+	}
+
+	delivery.Error = err.Error()
+	if delivery.Attempts >= hook.maxAttempts() {
+		l.Printf("Giving up %s event of file %s for %s after %d attempts: %v", delivery.Event, delivery.FileId, hook.URL, delivery.Attempts, err)
+		delivery.Status = DeliveryFailed
+		return
+	}
+	delivery.NextAttempt = time.Now().Add(hook.backoff(delivery.Attempts))
+}
+
+func (d *dispatcher) post(hook *Webhook, delivery *WebhookDelivery) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MMS-Event", delivery.Event)
+	req.Header.Set("X-MMS-Delivery", delivery.Id)
+	if hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	delivery.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", hook.URL, res.Status)
+	}
+	return nil
+}
@@ -1,43 +1,103 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
 	"github.com/joho/godotenv"
 	"os"
-	"os/signal"
-	"syscall"
+	"sort"
 )
 
-func main() {
-	watchDir, targetDir := "tmp/source", "tmp/target"
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+// set in init, the commands use it for their usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":           {serve, "serve [--config fm.yml] [--db mms_prod] [--http 127.0.0.1:8080] - watch directories and serve the API"},
+		"jobs":            {jobs, "jobs [--status failed] - list pending and failed imports"},
+		"import":          {importFiles, "import [--config fm.yml | --target dir] <path> - import a file, or the files of a directory, once"},
+		"list":            {list, "list [--status INVALID] [--source dir] [--name part] - list files"},
+		"show":            {show, "show <file> - show a file by id or name, with its history"},
+		"release":         {release, "release [--config fm.yml | --target dir --quarantine dir] <id> - take a file out of quarantine and import it again"},
+		"retry":           {retry, "retry <job> - queue a failed import again, the running file manager takes it up"},
+		"reprocess":       {reprocess, "reprocess [--config fm.yml | --target dir] <id> - run a FAILED or INVALID file through the import again"},
+		"validate-config": {validateConfig, "validate-config <file> - check a config file"},
+		"migrate":         {migrate, "migrate [--db mms_prod] - move RethinkDB records of older versions to the current tables"},
+	}
+}
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mms <command> [flags] [arguments]\n\nCommands:")
+
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  mms", commands[name].usage)
+	}
+
+	fmt.Fprintln(os.Stderr, "\nRun 'mms <command> -h' for the flags of a command.")
+}
+
+func main() {
 	godotenv.Load(".env")
 
-	fm, err := fm.NewFM("mms_prod")
-	if err != nil {
-		panic(err)
-	}
-	defer fm.Destroy()
-
-	fm.Watch(watchDir, targetDir)
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("Bye Bye")
-		fm.Destroy()
-		os.Exit(0)
-	}()
-
-	quit := make(chan bool, 1)
-	/*
-		for {
-			fmt.Println("sleeping...")
-			time.Sleep(10 * time.Second) // or runtime.Gosched() or similar per @misterbee
-		}
-	*/
-	<-quit
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "mms: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "mms:", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns flags of the named command with the common --db flag
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := newCommandFlags(name)
+	dbName := flags.String("db", envOr("DB_NAME", "mms_prod"), "database name, the store is selected by DATABASE_URL")
+	return flags, dbName
+}
+
+// newCommandFlags returns flags of the named command without --db, for
+// commands that don't open the store
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mms", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses flags and checks the number of positional arguments
+func parseArgs(flags *flag.FlagSet, args []string, n int) []string {
+	flags.Parse(args)
+	if flags.NArg() != n {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return flags.Args()
+}
+
+func envOr(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
 }
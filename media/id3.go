@@ -0,0 +1,236 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	id3v2HeaderSize = 10
+	id3v1Size       = 128
+)
+
+// tag names of ID3v2 text frames, ID3v2.2 uses three letter ids
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TALB": "album", "TAL": "album",
+	"TDRC": "date", "TYER": "date", "TYE": "date",
+	"TCON": "genre", "TCO": "genre",
+	"TLAN": "language", "TLA": "language",
+	"TRCK": "track", "TRK": "track",
+	"TCOP": "copyright", "TCR": "copyright",
+	"COMM": "comment", "COM": "comment",
+}
+
+// id3v2Size returns the size of the ID3v2 tag the header starts, or 0
+func id3v2Size(header []byte) int64 {
+	if len(header) < id3v2HeaderSize || string(header[:3]) != "ID3" {
+		return 0
+	}
+	size := id3v2HeaderSize + int64(syncsafe(header[6:10]))
+	// ID3v2.4 footer
+	if header[3] == 4 && header[5]&0x10 != 0 {
+		size += id3v2HeaderSize
+	}
+	return size
+}
+
+// parseID3v2 reads the text frames of an ID3v2.2, 2.3 or 2.4 tag
+func parseID3v2(tag []byte, info *Info) error {
+	version, flags := tag[3], tag[5]
+	if version < 2 || version > 4 {
+		return errors.New("unknown ID3v2 version")
+	}
+
+	body := tag[id3v2HeaderSize:]
+	if flags&0x80 != 0 && version < 4 {
+		body = unsync(body)
+	}
+
+	// extended header, its size includes itself in 2.4 only
+	if flags&0x40 != 0 && version > 2 && len(body) >= 4 {
+		size := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			size = syncsafe(body[:4])
+		} else {
+			size += 4
+		}
+		if size > len(body) {
+			return errors.New("bad ID3v2 extended header")
+		}
+		body = body[size:]
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+
+	for len(body) >= headerSize && body[0] != 0 {
+		id := string(body[:idSize])
+
+		var size int
+		switch version {
+		case 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		case 4:
+			size = syncsafe(body[4:8])
+		}
+		if size < 0 || headerSize+size > len(body) {
+			return errors.New("bad ID3v2 frame size")
+		}
+
+		data := body[headerSize : headerSize+size]
+		if version > 2 {
+			data = frameData(version, body[9], data)
+		}
+		body = body[headerSize+size:]
+
+		name, ok := id3Frames[id]
+		if !ok || len(data) == 0 {
+			continue
+		}
+		if id == "COMM" || id == "COM" {
+			info.setTag(name, decodeComment(data))
+		} else {
+			info.setTag(name, decodeText(data[0], data[1:]))
+		}
+	}
+	return nil
+}
+
+// frameData undoes the format flags of an ID3v2.3 or 2.4 frame,
+// compressed and encrypted frames are skipped
+func frameData(version, flags byte, data []byte) []byte {
+	var skip int
+	if version == 3 {
+		if flags&0xC0 != 0 {
+			return nil
+		}
+		if flags&0x20 != 0 {
+			skip++
+		}
+	} else {
+		if flags&0x0C != 0 {
+			return nil
+		}
+		if flags&0x40 != 0 {
+			skip++
+		}
+		if flags&0x01 != 0 {
+			skip += 4
+		}
+	}
+
+	if skip > len(data) {
+		return nil
+	}
+	data = data[skip:]
+	if version == 4 && flags&0x02 != 0 {
+		data = unsync(data)
+	}
+	return data
+}
+
+// parseID3v1 reads the fixed fields of an ID3v1 tag, if tag is one
+func parseID3v1(tag []byte, info *Info) bool {
+	if len(tag) != id3v1Size || string(tag[:3]) != "TAG" {
+		return false
+	}
+	info.setTag("title", latin1(tag[3:33]))
+	info.setTag("artist", latin1(tag[33:63]))
+	info.setTag("album", latin1(tag[63:93]))
+	info.setTag("date", latin1(tag[93:97]))
+	info.setTag("comment", latin1(tag[97:127]))
+	return true
+}
+
+// decodeComment skips the language and short description of a comment frame
+func decodeComment(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	encoding, text := data[0], data[4:]
+
+	// the description ends with a terminator of the encoding
+	terminator := []byte{0}
+	if encoding == 1 || encoding == 2 {
+		terminator = []byte{0, 0}
+	}
+	for i := 0; i+len(terminator) <= len(text); i += len(terminator) {
+		if bytes.Equal(text[i:i+len(terminator)], terminator) {
+			return decodeText(encoding, text[i+len(terminator):])
+		}
+	}
+	return ""
+}
+
+// decodeText returns the first value of a text frame
+func decodeText(encoding byte, data []byte) string {
+	var s string
+	switch encoding {
+	case 0:
+		s = latin1(data)
+	case 1, 2:
+		s = decodeUTF16(data, encoding == 1)
+	case 3:
+		s = string(data)
+		if !utf8.ValidString(s) {
+			return ""
+		}
+	default:
+		return ""
+	}
+
+	if i := bytes.IndexByte([]byte(s), 0); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+func decodeUTF16(data []byte, bom bool) string {
+	order := binary.ByteOrder(binary.BigEndian)
+	if bom && len(data) >= 2 {
+		switch {
+		case data[0] == 0xFF && data[1] == 0xFE:
+			order = binary.LittleEndian
+			data = data[2:]
+		case data[0] == 0xFE && data[1] == 0xFF:
+			data = data[2:]
+		}
+	}
+
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// syncsafe decodes integers that use 7 bits per byte
+func syncsafe(b []byte) int {
+	n := 0
+	for _, x := range b {
+		n = n<<7 | int(x&0x7F)
+	}
+	return n
+}
+
+// unsync removes the zero bytes inserted after 0xFF
+func unsync(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xFF, 0}, []byte{0xFF}, -1)
+}
@@ -0,0 +1,90 @@
+// Package media reads technical metadata and tags of media files
+// with pure Go parsers: ID3 and MPEG audio frames of MP3, boxes of
+// MP4 and EBML elements of Matroska (MKV, WebM).
+package media
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MP3 = "mp3"
+	MP4 = "mp4"
+	MKV = "mkv"
+)
+
+// ErrUnsupported is returned by Probe for files of other formats
+var ErrUnsupported = errors.New("unsupported media format")
+
+// Info is the metadata of a media file
+type Info struct {
+	Format string `gorethink:"format" json:"format"`
+	// Seconds
+	Duration float64 `gorethink:"duration" json:"duration"`
+	// Kbit/s, averaged over the file
+	Bitrate int `gorethink:"bitrate" json:"bitrate"`
+	// Names are lower case, e.g. title, artist, album, date, genre, language
+	Tags map[string]string `gorethink:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Format returns the format of the file by its extension, or "" if unsupported
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return MP3
+	case ".mp4", ".m4a", ".m4v", ".mov":
+		return MP4
+	case ".mkv", ".mka", ".webm":
+		return MKV
+	}
+	return ""
+}
+
+// Probe reads the metadata of the file at path
+func Probe(path string) (*Info, error) {
+	format := Format(path)
+	if format == "" {
+		return nil, ErrUnsupported
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Format: format, Tags: make(map[string]string)}
+	switch format {
+	case MP3:
+		err = probeMP3(f, stat.Size(), info)
+	case MP4:
+		err = probeMP4(f, stat.Size(), info)
+	case MKV:
+		err = probeMKV(f, stat.Size(), info)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad %s file %q: %v", format, path, err)
+	}
+
+	if info.Bitrate == 0 && info.Duration > 0 {
+		info.Bitrate = int(float64(stat.Size()) * 8 / info.Duration / 1000)
+	}
+	return info, nil
+}
+
+// setTag keeps the first non-empty value of a tag
+func (info *Info) setTag(name, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value != "" && info.Tags[name] == "" {
+		info.Tags[name] = value
+	}
+}
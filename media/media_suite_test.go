@@ -0,0 +1,13 @@
+package media_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMedia(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Media Suite")
+}
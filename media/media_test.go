@@ -0,0 +1,205 @@
+package media_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/Bnei-Baruch/mms-file-manager/media"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Media", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "media")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+		return path
+	}
+
+	It("must tell the format by the extension", func() {
+		Ω(media.Format("a/b.MP3")).Should(Equal(media.MP3))
+		Ω(media.Format("b.m4a")).Should(Equal(media.MP4))
+		Ω(media.Format("b.webm")).Should(Equal(media.MKV))
+		Ω(media.Format("b.doc")).Should(BeEmpty())
+
+		_, err := media.Probe(write("a.doc", []byte("text")))
+		Ω(err).Should(Equal(media.ErrUnsupported))
+	})
+
+	Context("MP3", func() {
+		It("must read ID3v2 tags, duration and bitrate", func() {
+			data := append(id3v2(map[string]string{"TIT2": "Lesson", "TPE1": "Rav", "TLAN": "heb"}), mp3Frames(100)...)
+			info, err := media.Probe(write("a.mp3", data))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(info.Format).Should(Equal(media.MP3))
+			Ω(info.Bitrate).Should(Equal(128))
+			Ω(info.Duration).Should(BeNumerically("~", 2.606, 0.01))
+			Ω(info.Tags).Should(Equal(map[string]string{"title": "Lesson", "artist": "Rav", "language": "heb"}))
+		})
+
+		It("must read ID3v1 tags", func() {
+			tag := make([]byte, 128)
+			copy(tag, "TAG")
+			copy(tag[3:], "Old title")
+			info, err := media.Probe(write("a.mp3", append(mp3Frames(10), tag...)))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Tags).Should(HaveKeyWithValue("title", "Old title"))
+			Ω(info.Duration).Should(BeNumerically("~", 0.26, 0.01))
+		})
+
+		It("must take the duration from the Xing header", func() {
+			frames := mp3Frames(10)
+			// stereo MPEG-1 side info is 32 bytes
+			copy(frames[36:], "Xing")
+			binary.BigEndian.PutUint32(frames[40:], 1)
+			binary.BigEndian.PutUint32(frames[44:], 1000)
+			info, err := media.Probe(write("a.mp3", frames))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Duration).Should(BeNumerically("~", 26.12, 0.01))
+		})
+
+		It("must fail without audio frames", func() {
+			_, err := media.Probe(write("a.mp3", id3v2(map[string]string{"TIT2": "Lesson"})))
+			Ω(err).Should(HaveOccurred())
+
+			_, err = media.Probe(write("b.mp3", nil))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("MP4", func() {
+		It("must read the movie header, language and metadata items", func() {
+			data := append(mp4File(5000, 1000, "heb", "Lesson"), box("mdat", make([]byte, 100000))...)
+			info, err := media.Probe(write("a.mp4", data))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(info.Format).Should(Equal(media.MP4))
+			Ω(info.Duration).Should(Equal(5.0))
+			Ω(info.Bitrate).Should(Equal(160))
+			Ω(info.Tags).Should(Equal(map[string]string{"title": "Lesson", "language": "heb"}))
+		})
+
+		It("must fail without a movie box", func() {
+			_, err := media.Probe(write("a.mp4", box("ftyp", []byte("isom\x00\x00\x02\x00"))))
+			Ω(err).Should(HaveOccurred())
+
+			_, err = media.Probe(write("b.mp4", []byte("not an mp4 file")))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("MKV", func() {
+		It("must read the segment info and tags", func() {
+			info, err := media.Probe(write("a.mkv", mkvFile("matroska", 3000)))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(info.Format).Should(Equal(media.MKV))
+			Ω(info.Duration).Should(Equal(3.0))
+			Ω(info.Tags).Should(Equal(map[string]string{"title": "Lesson", "artist": "Rav", "language": "heb"}))
+		})
+
+		It("must fail for other documents", func() {
+			_, err := media.Probe(write("a.mkv", mkvFile("other", 3000)))
+			Ω(err).Should(HaveOccurred())
+
+			_, err = media.Probe(write("b.mkv", []byte("not a matroska file")))
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
+
+// id3v2 builds an ID3v2.3 tag of latin1 text frames
+func id3v2(frames map[string]string) []byte {
+	body := &bytes.Buffer{}
+	for id, text := range frames {
+		body.WriteString(id)
+		binary.Write(body, binary.BigEndian, uint32(len(text)+1))
+		body.Write([]byte{0, 0, 0})
+		body.WriteString(text)
+	}
+
+	size := body.Len()
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	return append(header, body.Bytes()...)
+}
+
+// mp3Frames builds MPEG-1 layer III frames of 128 kbit/s at 44.1 kHz
+func mp3Frames(n int) []byte {
+	data := make([]byte, 417*n)
+	for i := 0; i < n; i++ {
+		copy(data[417*i:], []byte{0xFF, 0xFB, 0x90, 0x00})
+	}
+	return data
+}
+
+func box(typ string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)+8))
+	copy(header[4:], typ)
+	return append(header, data...)
+}
+
+func mp4File(duration, timescale uint32, lang, title string) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint16(mdhd[20:], uint16(lang[0]-0x60)<<10|uint16(lang[1]-0x60)<<5|uint16(lang[2]-0x60))
+
+	data := append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, title...)
+	return append(box("ftyp", []byte("isom\x00\x00\x02\x00")),
+		box("moov",
+			box("mvhd", mvhd),
+			box("trak", box("mdia", box("mdhd", mdhd))),
+			box("udta", box("meta", make([]byte, 4), box("ilst", box("\xa9nam", box("data", data))))),
+		)...)
+}
+
+// ebml builds an element with a two byte size
+func ebml(id uint32, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, id)
+	for head[0] == 0 {
+		head = head[1:]
+	}
+	return append(append(head, 0x40|byte(len(data)>>8), byte(len(data))), data...)
+}
+
+func mkvFile(docType string, duration float64) []byte {
+	float := make([]byte, 8)
+	binary.BigEndian.PutUint64(float, math.Float64bits(duration))
+
+	return append(ebml(0x1A45DFA3, ebml(0x4282, []byte(docType))),
+		ebml(0x18538067,
+			ebml(0x1549A966,
+				ebml(0x2AD7B1, []byte{0x0F, 0x42, 0x40}),
+				ebml(0x4489, float),
+				ebml(0x7BA9, []byte("Lesson")),
+			),
+			ebml(0x1654AE6B, ebml(0xAE, ebml(0x22B59C, []byte("heb")))),
+			ebml(0x1254C367, ebml(0x7373, ebml(0x67C8,
+				ebml(0x45A3, []byte("ARTIST")),
+				ebml(0x4487, []byte("Rav")),
+			))),
+		)...)
+}
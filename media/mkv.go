@@ -0,0 +1,267 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// EBML element ids, with their length marker bits
+const (
+	ebmlHeader    = 0x1A45DFA3
+	ebmlDocType   = 0x4282
+	mkvSegment    = 0x18538067
+	mkvInfo       = 0x1549A966
+	mkvScale      = 0x2AD7B1
+	mkvDuration   = 0x4489
+	mkvTitle      = 0x7BA9
+	mkvTracks     = 0x1654AE6B
+	mkvTrackEntry = 0xAE
+	mkvLanguage   = 0x22B59C
+	mkvTags       = 0x1254C367
+	mkvTag        = 0x7373
+	mkvSimpleTag  = 0x67C8
+	mkvTagName    = 0x45A3
+	mkvTagString  = 0x4487
+)
+
+// unknownSize marks elements that extend to the end of their parent
+const unknownSize = -1
+
+type element struct {
+	id         uint64
+	start, end int64 // of the content
+}
+
+// readVint reads an EBML variable length integer at offset, keeping
+// the length marker for ids. Returns the value and its length.
+func readVint(r io.ReaderAt, offset int64, marker bool) (uint64, int, error) {
+	first := make([]byte, 1)
+	if _, err := r.ReadAt(first, offset); err != nil {
+		return 0, 0, err
+	}
+
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("bad EBML variable length integer")
+	}
+
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return 0, 0, err
+	}
+	if !marker {
+		data[0] &= 0xFF >> uint(length)
+	}
+
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, length, nil
+}
+
+// walkElements calls fn for every element between start and end
+func walkElements(r io.ReaderAt, start, end int64, fn func(e element) error) error {
+	for offset := start; offset < end; {
+		id, n, err := readVint(r, offset, true)
+		if err != nil {
+			return err
+		}
+		size, m, err := readVint(r, offset+int64(n), false)
+		if err != nil {
+			return err
+		}
+
+		e := element{id: id, start: offset + int64(n+m)}
+		if size == 1<<uint(7*m)-1 {
+			e.end = end
+		} else {
+			e.end = e.start + int64(size)
+		}
+		if e.end > end || e.end < e.start {
+			return fmt.Errorf("bad size of EBML element %x", id)
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+		offset = e.end
+	}
+	return nil
+}
+
+func readElement(r io.ReaderAt, e element) ([]byte, error) {
+	if e.end-e.start > maxBoxRead {
+		return nil, fmt.Errorf("EBML element %x too large", e.id)
+	}
+	data := make([]byte, e.end-e.start)
+	_, err := r.ReadAt(data, e.start)
+	return data, err
+}
+
+func readUint(r io.ReaderAt, e element) (uint64, error) {
+	data, err := readElement(r, e)
+	if err != nil || len(data) > 8 {
+		return 0, errors.New("bad EBML unsigned integer")
+	}
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readFloat(r io.ReaderAt, e element) (float64, error) {
+	data, err := readElement(r, e)
+	if err != nil {
+		return 0, err
+	}
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	}
+	return 0, errors.New("bad EBML float")
+}
+
+func readString(r io.ReaderAt, e element) (string, error) {
+	data, err := readElement(r, e)
+	return string(data), err
+}
+
+/*
+ * Reads the segment info, the language of the first track and the
+ * simple tags of a Matroska file. Clusters of known size are skipped,
+ * reading stops at a cluster of unknown size.
+ */
+func probeMKV(r io.ReaderAt, size int64, info *Info) error {
+	isEBML := false
+	err := walkElements(r, 0, size, func(e element) error {
+		switch e.id {
+		case ebmlHeader:
+			isEBML = true
+			return walkElements(r, e.start, e.end, func(e element) error {
+				if e.id != ebmlDocType {
+					return nil
+				}
+				docType, err := readString(r, e)
+				if err == nil && docType != "matroska" && docType != "webm" {
+					err = fmt.Errorf("unknown document type %q", docType)
+				}
+				return err
+			})
+		case mkvSegment:
+			if !isEBML {
+				return errors.New("no EBML header found")
+			}
+			return probeSegment(r, e, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !isEBML {
+		return errors.New("no EBML header found")
+	}
+	return nil
+}
+
+func probeSegment(r io.ReaderAt, segment element, info *Info) error {
+	return walkElements(r, segment.start, segment.end, func(e element) error {
+		switch e.id {
+		case mkvInfo:
+			return parseSegmentInfo(r, e, info)
+		case mkvTracks:
+			return walkElements(r, e.start, e.end, func(e element) error {
+				if e.id != mkvTrackEntry {
+					return nil
+				}
+				return walkElements(r, e.start, e.end, func(e element) error {
+					if e.id != mkvLanguage {
+						return nil
+					}
+					lang, err := readString(r, e)
+					if lang != "und" {
+						info.setTag("language", lang)
+					}
+					return err
+				})
+			})
+		case mkvTags:
+			return parseTags(r, e, info)
+		}
+		return nil
+	})
+}
+
+func parseSegmentInfo(r io.ReaderAt, e element, info *Info) error {
+	scale, duration := uint64(1000000), 0.0
+	err := walkElements(r, e.start, e.end, func(e element) error {
+		var err error
+		switch e.id {
+		case mkvScale:
+			scale, err = readUint(r, e)
+		case mkvDuration:
+			duration, err = readFloat(r, e)
+		case mkvTitle:
+			var title string
+			title, err = readString(r, e)
+			info.setTag("title", title)
+		}
+		return err
+	})
+
+	// duration is in units of the timecode scale, which is in nanoseconds
+	info.Duration = duration * float64(scale) / 1e9
+	return err
+}
+
+func parseTags(r io.ReaderAt, tags element, info *Info) error {
+	return walkElements(r, tags.start, tags.end, func(tag element) error {
+		if tag.id != mkvTag {
+			return nil
+		}
+		return walkElements(r, tag.start, tag.end, func(simple element) error {
+			if simple.id != mkvSimpleTag {
+				return nil
+			}
+
+			var name, value string
+			err := walkElements(r, simple.start, simple.end, func(e element) error {
+				var err error
+				switch e.id {
+				case mkvTagName:
+					name, err = readString(r, e)
+				case mkvTagString:
+					value, err = readString(r, e)
+				}
+				return err
+			})
+			if name != "" {
+				info.setTag(mkvTagNames(name), value)
+			}
+			return err
+		})
+	})
+}
+
+// mkvTagNames maps official tag names such as DATE_RELEASED to
+// the names used for the other formats
+func mkvTagNames(name string) string {
+	switch name {
+	case "DATE_RELEASED", "DATE_RECORDED":
+		return "date"
+	case "ARTIST", "LEAD_PERFORMER":
+		return "artist"
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,214 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// how far past the tags the first audio frame is looked for
+const mp3SyncWindow = 64 * 1024
+
+var (
+	// kbit/s by bitrate index, for MPEG-1 layers I, II, III
+	// and MPEG-2/2.5 layer I and layers II, III
+	mpeg1Bitrates = [3][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	}
+	mpeg2Bitrates = [2][16]int{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	// Hz by sample rate index, for MPEG-1, 2 and 2.5
+	sampleRates = [3][3]int{
+		{44100, 48000, 32000},
+		{22050, 24000, 16000},
+		{11025, 12000, 8000},
+	}
+)
+
+// mpegFrame is a parsed MPEG audio frame header
+type mpegFrame struct {
+	version    int // 1, 2 or 3 for MPEG-2.5
+	layer      int
+	bitrate    int
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+func parseFrameHeader(b []byte) (*mpegFrame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return nil, false
+	}
+
+	f := &mpegFrame{}
+	switch (b[1] >> 3) & 3 {
+	case 0:
+		f.version = 3
+	case 2:
+		f.version = 2
+	case 3:
+		f.version = 1
+	default:
+		return nil, false
+	}
+
+	f.layer = 4 - int((b[1]>>1)&3)
+	bitrateIndex, rateIndex := b[2]>>4, (b[2]>>2)&3
+	if f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil, false
+	}
+
+	if f.version == 1 {
+		f.bitrate = mpeg1Bitrates[f.layer-1][bitrateIndex]
+	} else if f.layer == 1 {
+		f.bitrate = mpeg2Bitrates[0][bitrateIndex]
+	} else {
+		f.bitrate = mpeg2Bitrates[1][bitrateIndex]
+	}
+	f.sampleRate = sampleRates[f.version-1][rateIndex]
+	f.padding = int((b[2] >> 1) & 1)
+	f.mono = b[3]>>6 == 3
+	return f, true
+}
+
+func (f *mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version > 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+func (f *mpegFrame) size() int {
+	if f.layer == 1 {
+		return (12*f.bitrate*1000/f.sampleRate + f.padding) * 4
+	}
+	return f.samples()/8*f.bitrate*1000/f.sampleRate + f.padding
+}
+
+// sideInfoSize is where the Xing header starts after the frame header
+func (f *mpegFrame) sideInfoSize() int {
+	switch {
+	case f.version == 1 && !f.mono:
+		return 32
+	case f.version == 1 || !f.mono:
+		return 17
+	default:
+		return 9
+	}
+}
+
+/*
+ * Reads the ID3v2 and ID3v1 tags and the first audio frame. The duration
+ * comes from the Xing or VBRI header of variable bitrate files and from
+ * the frame bitrate of constant bitrate ones.
+ */
+func probeMP3(r io.ReaderAt, size int64, info *Info) error {
+	start, end := int64(0), size
+
+	header := make([]byte, id3v2HeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if start = id3v2Size(header); start > 0 {
+		if start > size {
+			return errors.New("ID3v2 tag exceeds the file")
+		}
+		tag := make([]byte, start)
+		if _, err := r.ReadAt(tag, 0); err != nil {
+			return err
+		}
+		if err := parseID3v2(tag, info); err != nil {
+			return err
+		}
+	}
+
+	if size-start >= id3v1Size {
+		tag := make([]byte, id3v1Size)
+		if _, err := r.ReadAt(tag, size-id3v1Size); err != nil {
+			return err
+		}
+		if parseID3v1(tag, info) {
+			end -= id3v1Size
+		}
+	}
+
+	window := make([]byte, mp3SyncWindow)
+	n, err := r.ReadAt(window, start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	window = window[:n]
+
+	offset, frame := findFrame(window)
+	if frame == nil {
+		return errors.New("no MPEG audio frames found")
+	}
+	audio := end - start - int64(offset)
+
+	if frames, bytes := vbrHeader(window[offset:], frame); frames > 0 {
+		info.Duration = float64(frames) * float64(frame.samples()) / float64(frame.sampleRate)
+		if bytes == 0 {
+			bytes = audio
+		}
+		info.Bitrate = int(float64(bytes) * 8 / info.Duration / 1000)
+		return nil
+	}
+
+	info.Bitrate = frame.bitrate
+	info.Duration = float64(audio) * 8 / float64(frame.bitrate*1000)
+	return nil
+}
+
+// findFrame returns the first frame followed by another one, so that
+// sync bits within other data aren't taken for a frame
+func findFrame(data []byte) (int, *mpegFrame) {
+	for i := 0; i+4 <= len(data); i++ {
+		frame, ok := parseFrameHeader(data[i:])
+		if !ok {
+			continue
+		}
+		next := i + frame.size()
+		if next+4 > len(data) {
+			// a single frame is all there is
+			return i, frame
+		}
+		if _, ok := parseFrameHeader(data[next:]); ok {
+			return i, frame
+		}
+	}
+	return 0, nil
+}
+
+// vbrHeader returns the number of frames and audio bytes from the Xing,
+// Info or VBRI header in the first frame, if any
+func vbrHeader(data []byte, frame *mpegFrame) (frames, bytes int64) {
+	if xing := 4 + frame.sideInfoSize(); len(data) >= xing+16 {
+		tag := string(data[xing : xing+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(data[xing+4:])
+			field := xing + 8
+			if flags&1 != 0 {
+				frames = int64(binary.BigEndian.Uint32(data[field:]))
+				field += 4
+			}
+			if flags&2 != 0 && len(data) >= field+4 {
+				bytes = int64(binary.BigEndian.Uint32(data[field:]))
+			}
+			return
+		}
+	}
+
+	if vbri := 4 + 32; len(data) >= vbri+18 && string(data[vbri:vbri+4]) == "VBRI" {
+		bytes = int64(binary.BigEndian.Uint32(data[vbri+10:]))
+		frames = int64(binary.BigEndian.Uint32(data[vbri+14:]))
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// boxes larger than this are never read into memory
+const maxBoxRead = 1 << 20
+
+// tag names of iTunes style metadata items
+var mp4Items = map[string]string{
+	"\xa9nam": "title",
+	"\xa9ART": "artist",
+	"\xa9alb": "album",
+	"\xa9day": "date",
+	"\xa9gen": "genre",
+	"\xa9cmt": "comment",
+	"\xa9too": "encoder",
+	"cprt":    "copyright",
+}
+
+type box struct {
+	typ          string
+	start, end   int64 // of the content
+	headerLength int64
+}
+
+// walkBoxes calls fn for every box between start and end
+func walkBoxes(r io.ReaderAt, start, end int64, fn func(b box) error) error {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+
+		b := box{typ: string(header[4:8]), headerLength: 8}
+		size := int64(binary.BigEndian.Uint32(header))
+		switch size {
+		case 0:
+			// box extends to the end
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			b.headerLength = 16
+		}
+		if size < b.headerLength || offset+size > end {
+			return fmt.Errorf("bad size of box %q", b.typ)
+		}
+
+		b.start, b.end = offset+b.headerLength, offset+size
+		if err := fn(b); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+func readBox(r io.ReaderAt, b box) ([]byte, error) {
+	if b.end-b.start > maxBoxRead {
+		return nil, fmt.Errorf("box %q too large", b.typ)
+	}
+	data := make([]byte, b.end-b.start)
+	_, err := r.ReadAt(data, b.start)
+	return data, err
+}
+
+// probeMP4 reads the movie header, the language of the first track
+// and the metadata items of the moov box
+func probeMP4(r io.ReaderAt, size int64, info *Info) error {
+	found := false
+	err := walkBoxes(r, 0, size, func(b box) error {
+		if b.typ != "moov" {
+			return nil
+		}
+		found = true
+		return walkBoxes(r, b.start, b.end, func(b box) error {
+			switch b.typ {
+			case "mvhd":
+				return parseMvhd(r, b, info)
+			case "trak":
+				return findBox(r, b, []string{"mdia", "mdhd"}, func(b box) error {
+					return parseMdhd(r, b, info)
+				})
+			case "udta":
+				return findBox(r, b, []string{"meta"}, func(b box) error {
+					return parseMeta(r, b, info)
+				})
+			case "meta":
+				return parseMeta(r, b, info)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("no moov box found")
+	}
+	return nil
+}
+
+// findBox calls fn for the box at path inside parent
+func findBox(r io.ReaderAt, parent box, path []string, fn func(b box) error) error {
+	return walkBoxes(r, parent.start, parent.end, func(b box) error {
+		if b.typ != path[0] {
+			return nil
+		}
+		if len(path) == 1 {
+			return fn(b)
+		}
+		return findBox(r, b, path[1:], fn)
+	})
+}
+
+func parseMvhd(r io.ReaderAt, b box, info *Info) error {
+	data, err := readBox(r, b)
+	if err != nil {
+		return err
+	}
+
+	var timescale, duration uint64
+	switch {
+	case len(data) >= 20 && data[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:]))
+	case len(data) >= 32 && data[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+		duration = binary.BigEndian.Uint64(data[24:])
+	default:
+		return errors.New("bad mvhd box")
+	}
+
+	if timescale > 0 {
+		info.Duration = float64(duration) / float64(timescale)
+	}
+	return nil
+}
+
+// parseMdhd reads the ISO 639-2 language code of a track
+func parseMdhd(r io.ReaderAt, b box, info *Info) error {
+	data, err := readBox(r, b)
+	if err != nil {
+		return err
+	}
+
+	offset := 20
+	if len(data) > 0 && data[0] == 1 {
+		offset = 32
+	}
+	if len(data) < offset+2 {
+		return errors.New("bad mdhd box")
+	}
+
+	packed := binary.BigEndian.Uint16(data[offset:])
+	lang := string([]byte{
+		byte(packed>>10&0x1F) + 0x60,
+		byte(packed>>5&0x1F) + 0x60,
+		byte(packed&0x1F) + 0x60,
+	})
+	if lang != "und" && packed != 0 {
+		info.setTag("language", lang)
+	}
+	return nil
+}
+
+// parseMeta reads the ilst box of a meta box
+func parseMeta(r io.ReaderAt, meta box, info *Info) error {
+	// meta is a full box, its children follow version and flags
+	meta.start += 4
+	return findBox(r, meta, []string{"ilst"}, func(ilst box) error {
+		return walkBoxes(r, ilst.start, ilst.end, func(item box) error {
+			name, ok := mp4Items[item.typ]
+			if !ok {
+				return nil
+			}
+			return findBox(r, item, []string{"data"}, func(b box) error {
+				data, err := readBox(r, b)
+				if err != nil {
+					return err
+				}
+				// type 1 is UTF-8 text, it follows the type and locale
+				if len(data) > 8 && binary.BigEndian.Uint32(data) == 1 {
+					info.setTag(name, string(data[8:]))
+				}
+				return nil
+			})
+		})
+	})
+}
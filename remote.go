@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	fm "github.com/Bnei-Baruch/mms-file-manager/file_manager"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileManager is what the commands need of a file manager, see openFM
+type fileManager interface {
+	ListFiles(filter *fm.FileFilter) ([]*fm.File, error)
+	FindFileById(id string) (*fm.File, error)
+	FindOneFile(fileName string) (*fm.File, error)
+	FileHistory(fileId string) ([]*fm.FileEvent, error)
+	Import(path string, pair fm.WatchPair) (*fm.File, error)
+	Reprocess(id string, pair fm.WatchPair) (*fm.File, error)
+	Release(id string, pair fm.WatchPair) (*fm.File, error)
+	ListJobs() ([]*fm.Job, error)
+	RetryJob(id string) (*fm.Job, error)
+	Destroy()
+}
+
+/*
+ * Opens the store selected by DATABASE_URL. A BoltDB file is locked by
+ * mms serve while it runs, the commands then go through its API at
+ * MMS_API, by default the address mms serve listens on by default.
+ */
+func openFM(dbName string) (fileManager, error) {
+	fileManager, err := fm.OpenFM(dbName)
+	if err == nil {
+		return fileManager, nil
+	}
+	if err != fm.ErrStoreLocked {
+		return nil, err
+	}
+
+	addr := envOr("MMS_API", "http://"+envOr("HTTP_ADDR", "127.0.0.1:8080"))
+	if strings.HasPrefix(addr, "http://:") {
+		addr = "http://127.0.0.1" + strings.TrimPrefix(addr, "http://")
+	}
+	fmt.Fprintf(os.Stderr, "The store is in use, going through the API at %s\n", addr)
+	return &remoteFM{addr: strings.TrimSuffix(addr, "/"), token: os.Getenv("API_TOKEN"), client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+// remoteFM runs the commands on the file manager of mms serve. Releasing
+// and reprocessing files use the pair the server watches their source with.
+type remoteFM struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func (r *remoteFM) ListFiles(filter *fm.FileFilter) ([]*fm.File, error) {
+	q := url.Values{}
+	for name, value := range map[string]string{"status": filter.Status, "source": filter.Source, "name": filter.NameContains} {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	if !filter.CreatedAfter.IsZero() {
+		q.Set("from", filter.CreatedAfter.Format(time.RFC3339))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		q.Set("to", filter.CreatedBefore.Format(time.RFC3339))
+	}
+	q.Set("offset", strconv.Itoa(filter.Offset))
+	// the API pages by 1000 at most
+	if filter.Limit > 0 && filter.Limit < 1000 {
+		q.Set("limit", strconv.Itoa(filter.Limit))
+	} else {
+		q.Set("limit", "1000")
+	}
+
+	files := []*fm.File{}
+	_, err := r.call("GET", "/files?"+q.Encode(), &files)
+	return files, err
+}
+
+func (r *remoteFM) FindFileById(id string) (*fm.File, error) {
+	file := &fm.File{}
+	if status, err := r.call("GET", "/files/"+url.PathEscape(id), file); status == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// FindOneFile returns the oldest file with the name, as the store does
+func (r *remoteFM) FindOneFile(fileName string) (*fm.File, error) {
+	files, err := r.ListFiles(&fm.FileFilter{NameContains: fileName})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.FileName == fileName {
+			return file, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *remoteFM) FileHistory(fileId string) ([]*fm.FileEvent, error) {
+	events := []*fm.FileEvent{}
+	_, err := r.call("GET", "/files/"+url.PathEscape(fileId)+"/history", &events)
+	return events, err
+}
+
+func (r *remoteFM) Import(path string, pair fm.WatchPair) (*fm.File, error) {
+	return nil, fmt.Errorf("mms serve is running, put %q into a watched directory instead", path)
+}
+
+func (r *remoteFM) Reprocess(id string, pair fm.WatchPair) (*fm.File, error) {
+	file := &fm.File{}
+	if _, err := r.call("POST", "/files/"+url.PathEscape(id)+"/reprocess", file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (r *remoteFM) Release(id string, pair fm.WatchPair) (*fm.File, error) {
+	file := &fm.File{}
+	if _, err := r.call("POST", "/files/"+url.PathEscape(id)+"/release", file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (r *remoteFM) ListJobs() ([]*fm.Job, error) {
+	jobs := []*fm.Job{}
+	_, err := r.call("GET", "/jobs", &jobs)
+	return jobs, err
+}
+
+func (r *remoteFM) RetryJob(id string) (*fm.Job, error) {
+	job := &fm.Job{}
+	if _, err := r.call("POST", "/jobs/"+url.PathEscape(id)+"/retry", job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (r *remoteFM) Destroy() {}
+
+// call sends the request and decodes the response into v, or returns
+// the error of the response
+func (r *remoteFM) call(method, path string, v interface{}) (int, error) {
+	req, err := http.NewRequest(method, r.addr+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode >= 300 {
+		e := map[string]string{}
+		if json.Unmarshal(body, &e) == nil && e["error"] != "" {
+			return res.StatusCode, fmt.Errorf("%s", e["error"])
+		}
+		return res.StatusCode, fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	return res.StatusCode, json.Unmarshal(body, v)
+}